@@ -0,0 +1,110 @@
+package main
+
+import (
+	"code.google.com/p/gorilla/sessions"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"musebot"
+	"musebot/logging"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// apiRequest is everything an API method gets to look at, whether it was
+// called over HTTP or sent as a websocket command.
+type apiRequest struct {
+	params  url.Values
+	session *sessions.Session
+	log     *logging.Logger // tagged with the request's ID, and who made it
+}
+
+func newApiRequest(params url.Values, session *sessions.Session, requestId string, via *logging.Logger) *apiRequest {
+	ar := &apiRequest{params: params, session: session}
+	ar.log = via.With("request", requestId, "user", ar.user())
+	return ar
+}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestId is whatever a proxy in front of us called r, so that our logs can
+// be matched up with its, or a new one if it didn't. Either way, it's sent
+// back in the response.
+func requestId(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get("X-Request-Id")
+	if len(id) == 0 || len(id) > 64 {
+		id = newRequestId()
+	}
+	w.Header().Set("X-Request-Id", id)
+	return id
+}
+
+type apiHandler func(*apiRequest) musebot.ApiResponse
+
+// wsCommands are the API methods which can also be called over the websocket,
+// by name.
+var wsCommands = make(map[string]apiHandler)
+
+var errNotAdmin = errors.New("You're not an administrator!")
+
+func (ar *apiRequest) get(name string) string {
+	return ar.params.Get(name)
+}
+
+func (ar *apiRequest) getInt(name string, def int) (int, error) {
+	v := ar.get(name)
+	if len(v) == 0 {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		return 0, errors.New("'" + name + "' must be a non-negative whole number")
+	}
+	return i, nil
+}
+
+func (ar *apiRequest) getBool(name string) bool {
+	v := ar.get(name)
+	return v == "1" || v == "true"
+}
+
+func (ar *apiRequest) user() string {
+	username, _ := ar.session.Values["username"].(string)
+	return username
+}
+
+func (ar *apiRequest) isAdmin() bool {
+	return isAdmin(ar.session)
+}
+
+// handleApi registers an API method for logged in users, both over HTTP at
+// path and as the websocket command with the given name.
+func handleApi(path string, command string, fn apiHandler) {
+	wsCommands[command] = fn
+	http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		sess := getSession(r)
+		if !enforceLoggedIn(sess, w) {
+			return
+		}
+
+		r.ParseForm()
+		ar := newApiRequest(r.Form, sess, requestId(w, r), httpLog)
+		ar.log.Debug("API call", "path", r.URL.Path)
+		writeApiResponse(w, fn(ar))
+	})
+}
+
+// handleAdminApi is handleApi for methods only administrators may use.
+func handleAdminApi(path string, command string, fn apiHandler) {
+	handleApi(path, command, func(ar *apiRequest) musebot.ApiResponse {
+		if !ar.isAdmin() {
+			return wrapApiError(errNotAdmin)
+		}
+		return fn(ar)
+	})
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"musebot"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNothingToAutoplay = errors.New("Autoplay couldn't find anything to play.")
+
+// autoplayCandidate is either a song from a provider, or a local file.
+type autoplayCandidate struct {
+	providerName string
+	providerId   string
+	localPath    string
+
+	// what a local file's playlist said it was, if it came from one
+	title, artist, album string
+}
+
+func (c autoplayCandidate) key() string {
+	if len(c.localPath) != 0 {
+		return c.localPath
+	}
+	return c.providerName + ":" + c.providerId
+}
+
+// parseSongRef understands "provider.Name:providerId" and absolute paths.
+func parseSongRef(ref string) (autoplayCandidate, bool) {
+	if strings.HasPrefix(ref, "/") {
+		return autoplayCandidate{localPath: ref}, true
+	}
+	colon := strings.Index(ref, ":")
+	if colon <= 0 || colon == len(ref)-1 {
+		return autoplayCandidate{}, false
+	}
+	return autoplayCandidate{providerName: ref[:colon], providerId: ref[colon+1:]}, true
+}
+
+// autoplayer keeps the music going when the queue runs dry, by queueing
+// popular songs from the history or something from the fallback playlist.
+type autoplayer struct {
+	sync.Mutex
+	zone     *zone
+	sources  []string
+	fallback []string
+	window   time.Duration
+	avoid    time.Duration
+
+	busy     bool
+	heldOff  bool                   // someone stopped playback on purpose
+	recent   map[string]time.Time   // what we've picked, in case there's no history
+	override []musebot.PlaylistItem // what the schedule wants played instead, if anything
+}
+
+func setupAutoplay(cfg *musebot.JsonCfg) {
+	if !cfg.Autoplay.Enabled {
+		return
+	}
+
+	sources := cfg.Autoplay.Sources
+	if len(sources) == 0 {
+		sources = []string{"history", "fallback"}
+	}
+	autoplayLog.Info("Autoplay is turned on", "sources", strings.Join(sources, ","))
+
+	for _, z := range zones {
+		z.autoplay = newAutoplayer(z, cfg.Autoplay, sources)
+	}
+	observeBackend(func(z *zone, m musebot.BackendMessage) {
+		z.autoplay.observe(m)
+	})
+}
+
+func newAutoplayer(z *zone, cfg musebot.AutoplayCfg, sources []string) *autoplayer {
+	a := &autoplayer{
+		zone:     z,
+		sources:  sources,
+		fallback: cfg.FallbackPlaylist,
+		window:   time.Duration(cfg.HistoryDays) * 24 * time.Hour,
+		avoid:    time.Duration(cfg.AvoidMinutes) * time.Minute,
+		recent:   make(map[string]time.Time),
+	}
+	if a.window <= 0 {
+		a.window = 30 * 24 * time.Hour
+	}
+	if a.avoid <= 0 {
+		a.avoid = 2 * time.Hour
+	}
+	return a
+}
+
+func (a *autoplayer) observe(m musebot.BackendMessage) {
+	if a == nil {
+		return
+	}
+
+	switch m.Type {
+	case musebot.EventPlaybackStateChange:
+		if m.Content.(musebot.PlaybackStateChangeEvent).State == "stop" {
+			a.trigger()
+		}
+	case musebot.EventSongChanged:
+		if m.Content.(musebot.SongChangedEvent).Song == nil {
+			a.trigger()
+		}
+	}
+}
+
+// holdOff stops autoplay from undoing someone stopping the music, until
+// somebody queues something again.
+func (a *autoplayer) holdOff() {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.heldOff = true
+}
+
+func (a *autoplayer) resume() {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.heldOff = false
+}
+
+// overrideFallback has autoplay play only from items, until it's called
+// again with nil.
+func (a *autoplayer) overrideFallback(items []musebot.PlaylistItem) {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	a.override = items
+	a.Unlock()
+
+	if items != nil {
+		a.trigger()
+	}
+}
+
+func (a *autoplayer) trigger() {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+
+	if a.busy || a.heldOff {
+		return
+	}
+	a.busy = true
+	go a.fill()
+}
+
+func (a *autoplayer) fill() {
+	defer func() {
+		a.Lock()
+		a.busy = false
+		a.Unlock()
+	}()
+
+	if len(schedules.quiet(a.zone)) != 0 || linkedZones.following(a.zone) {
+		return
+	}
+	if _, isPlaying, err := a.zone.backend.CurrentSong(); err != nil || isPlaying {
+		return
+	}
+	if queue, err := a.zone.backend.PlaybackQueue(); err != nil || len(queue) != 0 {
+		return
+	}
+
+	// give up after a few duds rather than hammering the providers
+	for attempt := 0; attempt < 3; attempt++ {
+		c, err := a.pick()
+		if err != nil {
+			autoplayLog.Warn("Couldn't pick anything to play", "zone", a.zone.name, "error", err)
+			return
+		}
+		err = a.queue(c)
+		if err == nil {
+			return
+		}
+		autoplayLog.Warn("Couldn't queue a song", "zone", a.zone.name, "song", c.key(), "error", err)
+	}
+}
+
+func (a *autoplayer) recentlyPlayed(now time.Time) map[string]bool {
+	a.Lock()
+	defer a.Unlock()
+
+	recent := make(map[string]bool)
+	for key, at := range a.recent {
+		if now.Sub(at) < a.avoid {
+			recent[key] = true
+		} else {
+			delete(a.recent, key)
+		}
+	}
+	if historyStore != nil {
+		for _, e := range historyStore.Since(now.Add(-a.avoid)) {
+			recent[autoplayCandidate{providerName: e.ProviderName, providerId: e.ProviderId}.key()] = true
+		}
+	}
+	return recent
+}
+
+// popularCandidates weights songs from the history by how often people have
+// chosen them, less how often they've been skipped.
+func (a *autoplayer) popularCandidates(now time.Time) (map[string]autoplayCandidate, map[string]int) {
+	candidates := make(map[string]autoplayCandidate)
+	weights := make(map[string]int)
+	if historyStore == nil {
+		return candidates, weights
+	}
+
+	for _, e := range historyStore.Since(now.Add(-a.window)) {
+		if len(e.ProviderId) == 0 {
+			continue // local files don't say where they came from
+		}
+		c := autoplayCandidate{providerName: e.ProviderName, providerId: e.ProviderId}
+		candidates[c.key()] = c
+		if _, ok := weights[c.key()]; !ok {
+			weights[c.key()] = 1
+		}
+		// our own picks don't make a song more popular, but they can be skipped
+		if e.Culprit != musebot.AutoplayCulprit {
+			weights[c.key()]++
+		}
+		if e.Skipped {
+			weights[c.key()] -= 2
+		}
+	}
+	return candidates, weights
+}
+
+func (a *autoplayer) fallbackCandidates() (map[string]autoplayCandidate, map[string]int) {
+	a.Lock()
+	defer a.Unlock()
+
+	candidates := make(map[string]autoplayCandidate)
+	weights := make(map[string]int)
+	if a.override != nil {
+		for _, item := range a.override {
+			c := autoplayCandidate{providerName: item.ProviderName, providerId: item.ProviderId}
+			if !item.HasProvider() {
+				c = autoplayCandidate{localPath: item.Location, title: item.Title, artist: item.Artist, album: item.Album}
+			}
+			candidates[c.key()] = c
+			weights[c.key()] = 1
+		}
+		return candidates, weights
+	}
+
+	for _, ref := range a.fallback {
+		if c, ok := parseSongRef(ref); ok {
+			candidates[c.key()] = c
+			weights[c.key()] = 1
+		}
+	}
+	return candidates, weights
+}
+
+func weightedPick(candidates map[string]autoplayCandidate, weights map[string]int, exclude map[string]bool) (autoplayCandidate, bool) {
+	total := 0
+	for key, weight := range weights {
+		if weight > 0 && !exclude[key] {
+			total += weight
+		}
+	}
+	if total == 0 {
+		return autoplayCandidate{}, false
+	}
+
+	n := rand.Intn(total)
+	for key, weight := range weights {
+		if weight <= 0 || exclude[key] {
+			continue
+		}
+		if n < weight {
+			return candidates[key], true
+		}
+		n -= weight
+	}
+	return autoplayCandidate{}, false
+}
+
+func (a *autoplayer) pick() (autoplayCandidate, error) {
+	now := time.Now()
+	recent := a.recentlyPlayed(now)
+
+	a.Lock()
+	sources := a.sources
+	if a.override != nil {
+		sources = []string{"fallback"}
+	}
+	a.Unlock()
+
+	for _, source := range sources {
+		var candidates map[string]autoplayCandidate
+		var weights map[string]int
+		switch source {
+		case "history":
+			candidates, weights = a.popularCandidates(now)
+		case "fallback":
+			candidates, weights = a.fallbackCandidates()
+		default:
+			continue
+		}
+
+		// providers which are down can't give us anything
+		for key, c := range candidates {
+			if len(c.providerName) != 0 && !providerHealth.isHealthy(c.providerName) {
+				delete(weights, key)
+			}
+		}
+
+		if c, ok := weightedPick(candidates, weights, recent); ok {
+			return c, nil
+		}
+	}
+	return autoplayCandidate{}, errNothingToAutoplay
+}
+
+func (a *autoplayer) queue(c autoplayCandidate) error {
+	a.Lock()
+	a.recent[c.key()] = time.Now()
+	a.Unlock()
+
+	if len(c.localPath) != 0 {
+		si := musebot.SongInfo{
+			Title:        c.title,
+			Artist:       c.artist,
+			Album:        c.album,
+			MusicUrl:     c.localPath,
+			ProviderName: "<<LOCAL>>",
+			QueueInfo:    &musebot.QueuedSongInfo{Culprit: musebot.AutoplayCulprit},
+		}
+		if len(si.Title) == 0 {
+			si.Title = filepath.Base(c.localPath)
+		}
+		if err := checkBlocklist(si); err != nil {
+			return err
+		}
+		return a.zone.backend.Add(si)
+	}
+
+	p, err := lookupProvider(c.providerName)
+	if err != nil {
+		return err
+	}
+	si := musebot.SongInfo{ProviderName: c.providerName, ProviderId: c.providerId, Provider: p}
+	if err := p.UpdateSongInfo(&si); err != nil {
+		return err
+	}
+	if err := checkBlocklist(si); err != nil {
+		return err
+	}
+
+	if resp, failed := fetchAndQueue(a.zone, &si, admitUnpoliced(a.zone, si, musebot.AutoplayCulprit), autoplayLog).(musebot.ErrorApiResponse); failed {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import "musebot"
+
+// backendObservers see every message from each zone's backend just before
+// it's passed on to the hub. They're called one at a time for each zone, in
+// the order they were added, so they mustn't hang about.
+var backendObservers []func(*zone, musebot.BackendMessage)
+
+func observeBackend(observer func(*zone, musebot.BackendMessage)) {
+	backendObservers = append(backendObservers, observer)
+}
+
+func forwardBackendMessages(z *zone, websocketbroadcast chan ZoneMessage) {
+	for {
+		m := <-z.pipe
+		for _, observer := range backendObservers {
+			observer(z, m)
+		}
+		websocketbroadcast <- ZoneMessage{z.name, musebot.SystemMessage(m)}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"musebot"
+	"musebot/blocklist"
+	"musebot/provider"
+)
+
+var blocklistStore *blocklist.Store
+
+var errBlocklistDisabled = errors.New("There's no blocklist on this server.")
+
+func setupBlocklist(cfg *musebot.JsonCfg) {
+	if len(cfg.BlocklistFile) == 0 {
+		blocklistLog.Info("No BlocklistFile configured, so nothing will be blocked.")
+		return
+	}
+
+	blocklistLog.Info("Loading the blocklist", "file", cfg.BlocklistFile)
+	var err error
+	blocklistStore, err = blocklist.Open(cfg.BlocklistFile)
+	if err != nil {
+		blocklistLog.Fatal("Couldn't open the blocklist file", "file", cfg.BlocklistFile, "error", err)
+	}
+}
+
+// checkBlocklist refuses songs which are on the blocklist, whoever's asking.
+func checkBlocklist(si musebot.SongInfo) error {
+	if blocklistStore == nil {
+		return nil
+	}
+	rule, blocked := blocklistStore.Match(si)
+	if !blocked {
+		return nil
+	}
+	if len(rule.Reason) != 0 {
+		return errors.New("That song's been blocked: " + rule.Reason)
+	}
+	return errors.New("That song's been blocked.")
+}
+
+// blockSearchResult says whether si should be left out of search results,
+// flagging it instead if that's what the blocklist wants.
+func blockSearchResult(si *musebot.SongInfo) bool {
+	if blocklistStore == nil {
+		return false
+	}
+	rule, blocked := blocklistStore.Match(*si)
+	if !blocked {
+		return false
+	}
+	if rule.Action == "hide" {
+		return true
+	}
+	si.BlockInfo = &musebot.BlockedSongInfo{rule.Id, rule.Reason}
+	return false
+}
+
+// hiddenFromSearch is what searches should leave out before they're paged,
+// or nil if the blocklist doesn't hide anything.
+func hiddenFromSearch() provider.ResultFilter {
+	if blocklistStore == nil {
+		return nil
+	}
+	for _, rule := range blocklistStore.List() {
+		if rule.Action == "hide" {
+			return blockSearchResult
+		}
+	}
+	return nil
+}
+
+func filterSearchResults(results []musebot.SongInfo) []musebot.SongInfo {
+	out := make([]musebot.SongInfo, 0, len(results))
+	for _, si := range results {
+		if !blockSearchResult(&si) {
+			out = append(out, si)
+		}
+	}
+	return out
+}
+
+func filterFederatedResults(results []musebot.FederatedSongInfo) []musebot.FederatedSongInfo {
+	out := make([]musebot.FederatedSongInfo, 0, len(results))
+	for _, si := range results {
+		if !blockSearchResult(&si.SongInfo) {
+			out = append(out, si)
+		}
+	}
+	return out
+}
+
+// blocklistApi wraps API methods which need the blocklist turned on.
+func blocklistApi(fn apiHandler) apiHandler {
+	return func(ar *apiRequest) musebot.ApiResponse {
+		if blocklistStore == nil {
+			return wrapApiError(errBlocklistDisabled)
+		}
+		return fn(ar)
+	}
+}
+
+func registerBlocklistApi() {
+	handleAdminApi("/api/blocklist/", "blocklist", blocklistApi(func(ar *apiRequest) musebot.ApiResponse {
+		return musebot.BlocklistApiResponse{blocklistStore.List()}
+	}))
+
+	handleAdminApi("/api/blocklist/add/", "blocklist_add", blocklistApi(func(ar *apiRequest) musebot.ApiResponse {
+		rule, err := blocklistStore.Add(musebot.BlocklistRule{
+			Field:   ar.get("field"),
+			Pattern: ar.get("pattern"),
+			Match:   ar.get("match"),
+			Action:  ar.get("action"),
+			Reason:  ar.get("reason"),
+			AddedBy: ar.user(),
+		})
+		if err != nil {
+			return wrapApiError(err)
+		}
+		ar.log.Info("Added blocklist rule", "rule", rule.Id, "field", rule.Field, "match", rule.Match, "pattern", rule.Pattern)
+		return musebot.BlocklistRuleApiResponse{rule}
+	}))
+
+	handleAdminApi("/api/blocklist/remove/", "blocklist_remove", blocklistApi(func(ar *apiRequest) musebot.ApiResponse {
+		if len(ar.get("id")) == 0 {
+			return wrapApiError(errors.New("You must pass an 'id' argument specifying the rule to remove!"))
+		}
+		id, err := ar.getInt("id", 0)
+		if err != nil {
+			return wrapApiError(err)
+		}
+		if err := blocklistStore.Remove(id); err != nil {
+			return wrapApiError(err)
+		}
+		ar.log.Info("Removed blocklist rule", "rule", id)
+		return musebot.BlocklistApiResponse{blocklistStore.List()}
+	}))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"musebot"
+	"net/http"
+)
+
+var (
+	errNoCoverArt          = errors.New("That provider doesn't have any cover art for us to fetch.")
+	errCoverArtUnavailable = errors.New("Couldn't fetch that cover art.")
+)
+
+// registerCoverArtHandler serves cover art for providers which can't give
+// clients a URL of their own; see musebot.CoverArtProxyUrl.
+func registerCoverArtHandler() {
+	http.HandleFunc("/api/cover_art/", func(w http.ResponseWriter, r *http.Request) {
+		sess := getSession(r)
+		if !enforceLoggedIn(sess, w) {
+			return
+		}
+		r.ParseForm()
+		ar := newApiRequest(r.Form, sess, requestId(w, r), httpLog)
+
+		p, err := lookupProvider(ar.get("provider"))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			writeApiResponse(w, wrapApiError(err))
+			return
+		}
+		fetcher, ok := p.(musebot.CoverArtFetcher)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			writeApiResponse(w, wrapApiError(errNoCoverArt))
+			return
+		}
+
+		image, contentType, err := fetcher.FetchCoverArt(ar.get("id"))
+		if err != nil {
+			ar.log.Warn("Couldn't fetch cover art", "provider", ar.get("provider"), "id", ar.get("id"), "error", err)
+			w.WriteHeader(http.StatusBadGateway)
+			writeApiResponse(w, wrapApiError(errCoverArtUnavailable))
+			return
+		}
+		defer image.Close()
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+		io.Copy(w, image)
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"musebot"
+	"net/http"
+	"sync"
+)
+
+// failingChecks are the readiness checks which failed last time, so that
+// only changes get logged, however often we're asked.
+var failingChecks = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+func noteCheck(name string, err error) {
+	failingChecks.Lock()
+	defer failingChecks.Unlock()
+
+	if err != nil && !failingChecks.names[name] {
+		httpLog.Warn("Not ready", "check", name, "error", err)
+		failingChecks.names[name] = true
+	} else if err == nil && failingChecks.names[name] {
+		httpLog.Info("Ready again", "check", name)
+		delete(failingChecks.names, name)
+	}
+}
+
+// readinessChecks are everything which has to be working for us to be any
+// use, in the order they're reported.
+func readinessChecks() []musebot.HealthCheckResult {
+	checks := make([]musebot.HealthCheckResult, 0, len(zoneOrder)+3)
+	check := func(name string, err error) {
+		noteCheck(name, err)
+		checks = append(checks, musebot.HealthCheckResult{name, err == nil})
+	}
+
+	var err error
+	if isShuttingDown() {
+		err = errShuttingDown
+	}
+	check("shutdown", err)
+
+	for _, name := range zoneOrder {
+		check("backend:"+name, checkBackend(zones[name].backend))
+	}
+
+	err = nil
+	if len(healthyProviders()) == 0 {
+		err = errors.New("No providers are available right now.")
+	}
+	check("providers", err)
+
+	err = nil
+	if sessionStore == nil {
+		err = errors.New("There's no session store, so nobody can log in.")
+	}
+	check("session_store", err)
+
+	return checks
+}
+
+func checkBackend(b musebot.Backend) error {
+	if hc, ok := b.(musebot.HealthChecker); ok {
+		return hc.HealthCheck()
+	}
+	_, _, err := b.CurrentSong()
+	return err
+}
+
+// registerHealthHandlers serves /healthz and /readyz for whatever's keeping
+// us running. Neither needs a login.
+func registerHealthHandlers() {
+	// if we can answer at all, we're alive
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeApiResponse(w, musebot.LivenessApiResponse{true})
+	})
+
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		resp := musebot.ReadinessApiResponse{Ready: true, Checks: readinessChecks()}
+		for _, c := range resp.Checks {
+			resp.Ready = resp.Ready && c.Ok
+		}
+		if !resp.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		writeApiResponse(w, resp)
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"musebot"
+	"musebot/history"
+	"strconv"
+	"time"
+)
+
+// songs which stop within this many seconds of the end count as finished
+const historyCompletionSlack = 5
+
+var historyStore *history.Store
+
+var errHistoryDisabled = errors.New("History isn't being kept on this server.")
+
+// historyRecorder writes down each song as it plays in a zone, and how it
+// ended.
+type historyRecorder struct {
+	zone        *zone
+	entryId     int // -1 when nothing's playing
+	song        musebot.SongInfo
+	startedAt   time.Time
+	position    float64
+	sawPosition bool
+}
+
+func (hr *historyRecorder) finish(now time.Time) {
+	if hr.entryId < 0 {
+		return
+	}
+
+	position := hr.position
+	if !hr.sawPosition {
+		position = now.Sub(hr.startedAt).Seconds()
+	}
+	completed := hr.song.Length <= 0 || position >= float64(hr.song.Length-historyCompletionSlack)
+
+	err := historyStore.Finish(hr.entryId, now, completed, len(votes.forSong(hr.zone, hr.song.Id)))
+	if err != nil {
+		historyLog.Warn("Couldn't record the end of a song in the history", "zone", hr.zone.name, "title", hr.song.Title, "error", err)
+	}
+	hr.entryId = -1
+}
+
+func (hr *historyRecorder) observe(m musebot.BackendMessage) {
+	now := time.Now()
+
+	switch m.Type {
+	case musebot.EventSongChanged:
+		hr.finish(now)
+
+		song := m.Content.(musebot.SongChangedEvent).Song
+		if song == nil {
+			return
+		}
+		id, err := historyStore.Start(hr.zone.name, *song, now)
+		if err != nil {
+			historyLog.Warn("Couldn't record a song in the history", "zone", hr.zone.name, "title", song.Title, "error", err)
+			return
+		}
+		hr.entryId = id
+		hr.song = *song
+		hr.startedAt = now
+		hr.position = 0
+		hr.sawPosition = false
+		if song.PlaybackInfo != nil {
+			hr.position = song.PlaybackInfo.Position
+		}
+
+	case musebot.EventPosition:
+		if p := m.Content.(musebot.PositionEvent); hr.entryId >= 0 && p.SongId == hr.song.Id {
+			hr.position = p.Position
+			hr.sawPosition = true
+		}
+
+	case musebot.EventSeeked:
+		if p := m.Content.(musebot.SeekedEvent); hr.entryId >= 0 && p.SongId == hr.song.Id {
+			hr.position = p.To
+			hr.sawPosition = true
+		}
+	}
+}
+
+func setupHistory(cfg *musebot.JsonCfg) {
+	if len(cfg.HistoryFile) == 0 {
+		historyLog.Info("No HistoryFile configured, so play history won't be kept.")
+		return
+	}
+
+	historyLog.Info("Loading play history", "file", cfg.HistoryFile)
+	var err error
+	historyStore, err = history.Open(cfg.HistoryFile)
+	if err != nil {
+		historyLog.Fatal("Couldn't open the history file", "file", cfg.HistoryFile, "error", err)
+	}
+
+	recorders := make(map[*zone]*historyRecorder)
+	for _, z := range zones {
+		recorders[z] = &historyRecorder{zone: z, entryId: -1}
+	}
+	observeBackend(func(z *zone, m musebot.BackendMessage) {
+		recorders[z].observe(m)
+	})
+}
+
+// parseTimeArg accepts times as either RFC 3339 or seconds since the epoch.
+func parseTimeArg(ar *apiRequest, name string, def time.Time) (time.Time, error) {
+	v := ar.get(name)
+	if len(v) == 0 {
+		return def, nil
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return def, errors.New("'" + name + "' must be a time, either in RFC 3339 format or in seconds since 1970")
+	}
+	return t, nil
+}
+
+func registerHistoryApi() {
+	handleApi("/api/history/", "history", func(ar *apiRequest) musebot.ApiResponse {
+		if historyStore == nil {
+			return wrapApiError(errHistoryDisabled)
+		}
+
+		offset, err := ar.getInt("offset", 0)
+		if err != nil {
+			return wrapApiError(err)
+		}
+		limit, err := ar.getInt("limit", 50)
+		if err != nil {
+			return wrapApiError(err)
+		}
+
+		entries, total := historyStore.Page(offset, limit)
+		return musebot.HistoryApiResponse{entries, musebot.PagingFor(musebot.SearchQuery{Offset: offset, Limit: limit}, len(entries), total)}
+	})
+
+	handleApi("/api/stats/", "stats", func(ar *apiRequest) musebot.ApiResponse {
+		if historyStore == nil {
+			return wrapApiError(errHistoryDisabled)
+		}
+
+		until, err := parseTimeArg(ar, "until", time.Now())
+		if err != nil {
+			return wrapApiError(err)
+		}
+		days, err := ar.getInt("days", 7)
+		if err != nil {
+			return wrapApiError(err)
+		}
+		since, err := parseTimeArg(ar, "since", until.AddDate(0, 0, -days))
+		if err != nil {
+			return wrapApiError(err)
+		}
+		limit, err := ar.getInt("limit", 10)
+		if err != nil {
+			return wrapApiError(err)
+		}
+
+		return musebot.StatsApiResponse{historyStore.Stats(since, until, limit)}
+	})
+}
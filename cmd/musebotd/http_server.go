@@ -6,16 +6,17 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"log"
 	"musebot"
 	"musebot/provider"
 	"net/http"
-	"os"
-	"strconv"
+	"time"
 )
 
 var sessionStore sessions.Store
-var jobIdGenerator = make(chan int)
+
+var searchTimeout time.Duration
+
+var httpServers []*http.Server // so that they can be shut down
 
 func writeApiResponse(w http.ResponseWriter, ar musebot.ApiResponse) {
 	b, err := json.Marshal(ar)
@@ -63,273 +64,273 @@ func enforceLoggedIn(session *sessions.Session, w http.ResponseWriter) bool {
 	return true
 }
 
+// parseSearchQuery reads the field-scoped query in q along with the paging
+// and length arguments that go with it.
+func parseSearchQuery(ar *apiRequest, q string) (musebot.SearchQuery, error) {
+	sq := musebot.ParseSearchQuery(q)
+
+	var err error
+	if sq.Offset, err = ar.getInt("offset", 0); err != nil {
+		return sq, err
+	}
+	if sq.Limit, err = ar.getInt("limit", 0); err != nil {
+		return sq, err
+	}
+	if sq.MinLength, err = ar.getInt("min_length", 0); err != nil {
+		return sq, err
+	}
+	if sq.MaxLength, err = ar.getInt("max_length", 0); err != nil {
+		return sq, err
+	}
+	return sq, nil
+}
+
 func runHttpServer(cfg *musebot.JsonCfg) {
 	if len(cfg.SessionStoreAuthKey) != 32 && len(cfg.SessionStoreAuthKey) != 64 {
 		b64 := base64.StdEncoding
-		log.Fatalln("SessionStoreAuthKey must be 32 or 64 bytes long, not", len(cfg.SessionStoreAuthKey), "bytes! Here's a suggested value:", b64.EncodeToString(securecookie.GenerateRandomKey(64)))
+		httpLog.Fatal("SessionStoreAuthKey must be 32 or 64 bytes long", "length", len(cfg.SessionStoreAuthKey), "suggestion", b64.EncodeToString(securecookie.GenerateRandomKey(64)))
 	}
 	sessionStore = sessions.NewCookieStore(cfg.SessionStoreAuthKey)
 
-	// let's try to get the default provider
-	defaultProvider, wasFound := musebot.CurrentProviders[config.DefaultProvider]
-	if !wasFound {
-		for _, p := range musebot.CurrentProviders {
-			defaultProvider = p
-			break
-		}
+	searchTimeout = time.Duration(cfg.SearchTimeout) * time.Second
+	if searchTimeout <= 0 {
+		searchTimeout = 10 * time.Second
 	}
 
-	// job ID generator
-	go func(generatorPipe chan int) {
-		i := 0
-		for {
-			generatorPipe <- i
-			i = i + 1
-		}
-	}(jobIdGenerator)
+	voteThreshold := cfg.VoteSkipThreshold
+	if voteThreshold <= 0 {
+		voteThreshold = 3
+	}
 
-	var eProviderNotFound = errors.New("Provider not found")
+	startJobIdGenerator()
 
 	// GO GO WEB HANDLER
-	http.HandleFunc("/api/current_song/", func(w http.ResponseWriter, r *http.Request) {
-		if !enforceLoggedIn(getSession(r), w) {
-			return
-		}
+	handleApi("/api/ping/", "ping", func(ar *apiRequest) musebot.ApiResponse {
+		return musebot.PongApiResponse{time.Now()}
+	})
 
-		currentSong, isPlaying, err := musebot.CurrentBackend.CurrentSong()
+	handleApi("/api/current_song/", "current_song", func(ar *apiRequest) musebot.ApiResponse {
+		z, err := ar.zone()
 		if err != nil {
-			writeApiResponse(w, wrapApiError(err))
-		} else {
-			if isPlaying {
-				writeApiResponse(w, musebot.CurrentSongApiResponse{Playing: isPlaying, CurrentSong: &currentSong})
-			} else {
-				writeApiResponse(w, musebot.CurrentSongApiResponse{Playing: isPlaying, CurrentSong: nil})
-			}
+			return wrapApiError(err)
+		}
+		currentSong, isPlaying, err := z.backend.CurrentSong()
+		if err != nil {
+			return wrapApiError(err)
+		}
+		if !isPlaying {
+			return musebot.CurrentSongApiResponse{Playing: isPlaying, CurrentSong: nil}
 		}
+		annotateVotes(z, &currentSong)
+		return musebot.CurrentSongApiResponse{Playing: isPlaying, CurrentSong: &currentSong}
 	})
 
-	http.HandleFunc("/api/playback_queue/", func(w http.ResponseWriter, r *http.Request) {
-		if !enforceLoggedIn(getSession(r), w) {
-			return
+	handleApi("/api/playback_queue/", "playback_queue", func(ar *apiRequest) musebot.ApiResponse {
+		z, err := ar.zone()
+		if err != nil {
+			return wrapApiError(err)
 		}
-
-		playbackQueue, err := musebot.CurrentBackend.PlaybackQueue()
+		playbackQueue, err := z.backend.PlaybackQueue()
 		if err != nil {
-			writeApiResponse(w, wrapApiError(err))
-		} else {
-			writeApiResponse(w, musebot.PlaybackQueueApiResponse{playbackQueue})
+			return wrapApiError(err)
 		}
-	})
-
-	http.HandleFunc("/api/search_and_queue_first/", func(w http.ResponseWriter, r *http.Request) {
-		if !enforceLoggedIn(getSession(r), w) {
-			return
+		for i := range playbackQueue {
+			annotateVotes(z, &playbackQueue[i])
 		}
+		return musebot.PlaybackQueueApiResponse{playbackQueue}
+	})
 
+	handleApi("/api/search_and_queue_first/", "search_and_queue_first", func(ar *apiRequest) musebot.ApiResponse {
 		// get the query!
-		queryStrMap := r.URL.Query()
-		queryArray, ok := queryStrMap["q"]
-		if !ok || len(queryArray) < 1 || len(queryArray[0]) == 0 {
-			writeApiResponse(w, wrapApiError(errors.New("You must pass a 'q' argument specifying the query!")))
-			return
+		query := ar.get("q")
+		if len(query) == 0 {
+			return wrapApiError(errors.New("You must pass a 'q' argument specifying the query!"))
 		}
 
-		query := queryArray[0]
-		// cool
-
-		searchRes, err := musebot.CurrentProviders["provider.GroovesharkProvider"].Search(query)
+		z, err := ar.zone()
 		if err != nil {
-			writeApiResponse(w, wrapApiError(err))
-			return
+			return wrapApiError(err)
 		}
 
-		if len(searchRes) == 0 {
-			writeApiResponse(w, wrapApiError(errors.New("There were no results for that query.")))
-			return
+		var searchProvider musebot.Provider
+		if providerName := ar.get("provider"); len(providerName) != 0 {
+			searchProvider, err = lookupProvider(providerName)
+		} else {
+			searchProvider, err = pickDefaultProvider()
+		}
+		if err != nil {
+			return wrapApiError(err)
 		}
 
-		fetchChan := make(chan musebot.ProviderMessage, 1000)
-		log.Println(searchRes[0].Title)
-
-		go searchRes[0].Provider.FetchSong(&searchRes[0], fetchChan)
-
-		waitToEnd := make(chan bool)
+		q := musebot.ParseSearchQuery(query)
+		q.Limit = 1
+		searchResults, err := provider.Search(searchProvider, q, nil)
+		if err != nil {
+			return wrapApiError(err)
+		}
 
-		go (func(fetchChan chan musebot.ProviderMessage, song *musebot.SongInfo, done chan bool) {
-			for {
-				msg := <-fetchChan
-				log.Println(msg)
-				if msg.Type == "done" {
-					musebot.CurrentBackend.Add(*song)
-					writeApiResponse(w, musebot.QueuedApiResponse{*song})
-					done <- true
-					return
-				} else if msg.Type == "error" {
-					writeApiResponse(w, wrapApiError(msg.Content.(error)))
-					done <- true
-					return
-				}
-			}
-		})(fetchChan, &searchRes[0], waitToEnd)
+		if len(searchResults.Results) == 0 {
+			return wrapApiError(errors.New("There were no results for that query."))
+		}
 
-		<-waitToEnd
+		qa, err := admitToQueue(z, searchResults.Results[0], ar)
+		if err != nil {
+			return wrapApiError(err)
+		}
 
+		return fetchAndQueue(z, &searchResults.Results[0], qa, ar.log)
 	})
 
-	http.HandleFunc("/api/available_providers/", func(w http.ResponseWriter, r *http.Request) {
-		if !enforceLoggedIn(getSession(r), w) {
-			return
-		}
-
+	handleApi("/api/available_providers/", "available_providers", func(ar *apiRequest) musebot.ApiResponse {
 		outputBlah := make(map[string]string)
-		for k, v := range musebot.CurrentProviders {
+		capabilities := make(map[string]musebot.SearchCapabilities)
+		for k, v := range healthyProviders() {
 			outputBlah[k] = v.Name()
+			capabilities[k] = v.SearchCapabilities()
 		}
-		writeApiResponse(w, musebot.AvailableProvidersApiResponse{outputBlah})
+		return musebot.AvailableProvidersApiResponse{outputBlah, capabilities, providerHealth.snapshot()}
 	})
 
-	http.HandleFunc("/api/search/", func(w http.ResponseWriter, r *http.Request) {
-		if !enforceLoggedIn(getSession(r), w) {
-			return
+	handleApi("/api/search/", "search", func(ar *apiRequest) musebot.ApiResponse {
+		// get the query!
+		query := ar.get("q")
+		if len(query) == 0 {
+			return wrapApiError(errors.New("You must pass a 'q' argument specifying the query!"))
 		}
 
-		// get the query!
-		queryStrMap := r.URL.Query()
-		qArray, ok := queryStrMap["q"]
-		if !ok || len(qArray) < 1 || len(qArray[0]) == 0 {
-			writeApiResponse(w, wrapApiError(errors.New("You must pass a 'q' argument specifying the query!")))
-			return
+		q, err := parseSearchQuery(ar, query)
+		if err != nil {
+			return wrapApiError(err)
 		}
 
-		q := qArray[0]
+		// federated searches ask everyone
+		if ar.getBool("federated") {
+			results, total, failures := provider.FederatedSearch(healthyProviders(), q, searchTimeout, hiddenFromSearch())
+			results = filterFederatedResults(results)
+			paging := musebot.PagingFor(q, len(results), total)
+			return musebot.FederatedSearchResultsApiResponse{results, failures, paging}
+		}
 
 		// now the provider
-		providerArray, ok := queryStrMap["provider"]
-		var provider provider.Provider
-		if !ok || len(providerArray) < 1 || len(providerArray[0]) == 0 {
-			provider = defaultProvider
+		var searchProvider musebot.Provider
+		if providerName := ar.get("provider"); len(providerName) == 0 {
+			searchProvider, err = pickDefaultProvider()
 		} else {
-			providerName := providerArray[0]
-			provider, ok = musebot.CurrentProviders[providerName]
-			if !ok {
-				writeApiResponse(w, wrapApiError(eProviderNotFound))
-				return
-			}
+			searchProvider, err = lookupProvider(providerName)
+		}
+		if err != nil {
+			return wrapApiError(err)
 		}
 
 		// now we have a provider, we can search!
-		searchResults, err := provider.Search(q)
+		searchResults, err := provider.Search(searchProvider, q, hiddenFromSearch())
 		if err != nil {
-			writeApiResponse(w, wrapApiError(err))
-			return
+			return wrapApiError(err)
 		}
-		writeApiResponse(w, musebot.SearchResultsApiResponse{searchResults})
+		results := filterSearchResults(searchResults.Results)
+		paging := musebot.PagingFor(q, len(results), searchResults.Total)
+		return musebot.SearchResultsApiResponse{results, paging}
 	})
 
-	http.HandleFunc("/api/logout/", func(w http.ResponseWriter, r *http.Request) {
-		sess := getSession(r)
-		result := true
-		if !isLoggedIn(sess) {
-			result = false
+	handleApi("/api/add_to_queue/", "add_to_queue", func(ar *apiRequest) musebot.ApiResponse {
+		z, err := ar.zone()
+		if err != nil {
+			return wrapApiError(err)
 		}
 
-		// cool
-		sess.Values = map[interface{}]interface{}{}
-		sess.Save(r, w)
+		providerName := ar.get("provider")
+		providerId := ar.get("provider_id")
 
-		writeApiResponse(w, musebot.LoggedOutApiResponse{result})
-		return
-	})
-
-	http.HandleFunc("/api/quit/", func(w http.ResponseWriter, r *http.Request) {
-		if !enforceLoggedIn(getSession(r), w) {
-			return
+		si := musebot.SongInfo{}
+		si.ProviderName = providerName
+		si.ProviderId = providerId
+		provider, err := lookupProvider(providerName)
+		if err != nil {
+			return wrapApiError(err)
 		}
 
-		log.Println()
-		log.Println("Exiting on request!")
-		os.Exit(0)
-	})
+		si.Provider = provider
 
-	http.HandleFunc("/api/add_to_queue/", func(w http.ResponseWriter, r *http.Request) {
-		sess := getSession(r)
-		if !enforceLoggedIn(sess, w) {
-			return
+		err = si.Provider.UpdateSongInfo(&si)
+		if err != nil {
+			return wrapApiError(err)
 		}
 
-		providerName := r.FormValue("provider")
-		providerId := r.FormValue("provider_id")
+		qa, err := admitToQueue(z, si, ar)
+		if err != nil {
+			return wrapApiError(err)
+		}
 
-		si := musebot.SongInfo{}
-		si.ProviderName = providerName
-		si.ProviderId = providerId
-		provider, exists := musebot.CurrentProviders[providerName]
+		return fetchAndQueue(z, &si, qa, ar.log)
+	})
 
-		if !exists {
-			writeApiResponse(w, wrapApiError(errors.New("That provider doesn't exist.")))
+	handleApi("/api/vote/", "vote", func(ar *apiRequest) musebot.ApiResponse {
+		songId := ar.get("song_id")
+		if len(songId) == 0 {
+			return wrapApiError(errors.New("You must pass a 'song_id' argument specifying the song to vote against!"))
 		}
 
-		si.Provider = provider
+		z, err := ar.zone()
+		if err != nil {
+			return wrapApiError(err)
+		}
 
-		log.Println("UPDATING SONG INFO")
-
-		si.Provider.UpdateSongInfo(&si)
-
-		log.Println(si)
-
-		provMessage := make(chan musebot.ProviderMessage)
-		quit := make(chan bool)
-		go si.Provider.FetchSong(&si, provMessage)
-
-		log.Println(si, provMessage)
-
-		log.Println(sess.Values["username"])
-
-		go func(quit chan bool, provMessage chan musebot.ProviderMessage, w http.ResponseWriter, s *musebot.SongInfo, user string) {
-			hasQuit := false
-			jobId := <-jobIdGenerator
-			var m musebot.ProviderMessage
-			for {
-				m = <-provMessage
-				if m.Type == "error" {
-					if !hasQuit {
-						writeApiResponse(w, wrapApiError(m.Content.(error)))
-						quit <- true
-						return // done
-					}
-				} else if m.Type == "stages" {
-					if !hasQuit {
-						// tell them that we're AWESOME
-						if m.Content == 0 {
-							log.Println("ORDERING BACKEND TO ADD", s)
-							musebot.CurrentBackend.Add(*s)
-							writeApiResponse(w, musebot.QueuedApiResponse{*s})
-							quit <- true
-							return // done
-						} else {
-							writeApiResponse(w, musebot.JobQueuedApiResponse{strconv.Itoa(jobId)})
-							quit <- true
-							hasQuit = true
-						}
-					}
-				} else if m.Type == "done" && hasQuit {
-					musebot.CurrentBackend.Add(*s)
+		resp, err := voteAgainst(z, songId, ar.user(), voteThreshold)
+		if err != nil {
+			return wrapApiError(err)
+		}
+		return resp
+	})
+
+	transportControls := map[string]func(musebot.Backend) error{
+		"play":  musebot.Backend.Play,
+		"pause": musebot.Backend.Pause,
+		"stop":  musebot.Backend.Stop,
+		"skip":  musebot.Backend.Next,
+	}
+	for action, control := range transportControls {
+		func(action string, control func(musebot.Backend) error) {
+			handleAdminApi("/api/"+action+"/", action, func(ar *apiRequest) musebot.ApiResponse {
+				z, err := ar.zone()
+				if err != nil {
+					return wrapApiError(err)
 				}
-				if hasQuit {
-					outputData := musebot.JobWebSocketApiResponse{JobId: strconv.Itoa(jobId), Data: m}
-					jsonData, _ := json.Marshal(outputData)
-					userOutputData := UserMessage{user: user, message: "JOB_DATA " + string(jsonData)}
-					h.broadcastUser <- userOutputData
+				if err := control(z.backend); err != nil {
+					return wrapApiError(err)
 				}
-			}
-		}(quit, provMessage, w, &si, sess.Values["username"].(string))
+				if action == "stop" {
+					z.autoplay.holdOff()
+				}
+				return musebot.TransportApiResponse{action}
+			})
+		}(action, control)
+	}
 
-		<-quit
+	http.HandleFunc("/api/logout/", func(w http.ResponseWriter, r *http.Request) {
+		sess := getSession(r)
+		result := true
+		if !isLoggedIn(sess) {
+			result = false
+		}
 
+		// cool
+		sess.Values = map[interface{}]interface{}{}
+		sess.Save(r, w)
+
+		writeApiResponse(w, musebot.LoggedOutApiResponse{result})
+		return
+	})
+
+	// shuts down the same way as it would on SIGTERM
+	handleAdminApi("/api/quit/", "quit", func(ar *apiRequest) musebot.ApiResponse {
+		reason := "Asked to by " + ar.user()
+		ar.log.Info("Exiting on request!")
+		requestShutdown(reason)
+		return musebot.ShuttingDownApiResponse{reason}
 	})
 
 	http.HandleFunc("/api/login/", func(w http.ResponseWriter, r *http.Request) {
-		if r.TLS == nil {
+		if !isSecure(r) {
 			writeApiResponse(w, wrapApiError(errors.New("This method requires TLS! :<")))
 			return
 		}
@@ -339,13 +340,17 @@ func runHttpServer(cfg *musebot.JsonCfg) {
 		username := r.FormValue("username")
 		password := r.FormValue("password")
 
+		log := authLog.With("request", requestId(w, r), "username", username, "remote", r.RemoteAddr)
+
 		a := musebot.CurrentAuthenticator
 		result, user, err := a.CheckLogin(username, password)
 		if err != nil {
+			log.Error("Couldn't check a login", "error", err)
 			writeApiResponse(w, wrapApiError(err))
 			return
 		}
 		if result {
+			log.Info("Logged in")
 			sess.Values["logged-in"] = true
 			sess.Values["username"] = user.Username
 			sess.Values["administrator"] = user.Administrator
@@ -353,13 +358,15 @@ func runHttpServer(cfg *musebot.JsonCfg) {
 
 			writeApiResponse(w, musebot.LoggedInApiResponse{username})
 		} else {
+			log.Warn("Login refused")
+			loginFailures.Inc()
 			writeApiResponse(w, wrapApiError(errors.New("The username or password was incorrect.")))
 		}
 
 	})
 
 	http.HandleFunc("/api/masquerade/", func(w http.ResponseWriter, r *http.Request) {
-		if r.TLS == nil {
+		if !isSecure(r) {
 			writeApiResponse(w, wrapApiError(errors.New("This method requires TLS! :<")))
 			return
 		}
@@ -370,8 +377,8 @@ func runHttpServer(cfg *musebot.JsonCfg) {
 			return
 		}
 
-		if !isSessionBool(sess, "administrator") {
-			writeApiResponse(w, wrapApiError(errors.New("You're not an administrator!")))
+		if !isAdmin(sess) {
+			writeApiResponse(w, wrapApiError(errNotAdmin))
 			return
 		}
 
@@ -384,6 +391,7 @@ func runHttpServer(cfg *musebot.JsonCfg) {
 
 		q := qArray[0]
 
+		authLog.Info("Masquerading", "request", requestId(w, r), "user", sess.Values["username"], "as", q)
 		sess.Values["logged-in"] = true
 		sess.Values["username"] = q
 		sess.Values["administrator"] = true
@@ -395,22 +403,55 @@ func runHttpServer(cfg *musebot.JsonCfg) {
 
 	})
 
-	registerWsHandler()
+	registerHistoryApi()
+	registerPlaylistApi()
+	registerPlaylistFileApi()
+	registerBlocklistApi()
+	registerScheduleApi()
+	registerZoneApi()
+	registerPartyApi()
+	registerCoverArtHandler()
+	registerMetricsHandler()
+	registerHealthHandlers()
+	registerUi()
+	registerWsHandler(cfg)
+	registerSseHandler()
+
+	setupTrustedProxies(cfg.Tls)
+	if len(cfg.SslListenAddr) == 0 {
+		if len(trustedProxies) == 0 {
+			httpLog.Fatal("The HTTPS server *must* run unless there's a TrustedProxies doing TLS for us. Login will only take place over HTTPS.")
+		}
+		httpLog.Info("There's no HTTPS server, so logins can only come through TrustedProxies")
+	}
+	tlsConfig, certFile, keyFile, acmeManager := setupTlsConfig(cfg.Tls)
 
 	if len(cfg.ListenAddr) != 0 {
-		httpServer := &http.Server{Addr: cfg.ListenAddr}
+		var handler http.Handler = http.DefaultServeMux
+		if cfg.Tls.RedirectHttp {
+			handler = redirectToHttps(cfg.SslListenAddr, handler)
+		}
+		if acmeManager != nil {
+			handler = acmeManager.HTTPHandler(handler)
+		}
+		httpServer := &http.Server{Addr: cfg.ListenAddr, Handler: handler}
+		httpServers = append(httpServers, httpServer)
 		go func() {
-			log.Fatalln(httpServer.ListenAndServe())
+			if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+				httpLog.Fatal("The HTTP server stopped", "error", err)
+			}
 		}()
-		log.Println(" - HTTP Server is listening on", cfg.ListenAddr)
+		httpLog.Info("HTTP server is listening", "addr", cfg.ListenAddr, "redirect", cfg.Tls.RedirectHttp)
 	}
 
-	if len(cfg.SslListenAddr) == 0 {
-		log.Fatalln(" x The HTTPS server *must* run. Login will only take place over HTTPS.")
+	if len(cfg.SslListenAddr) != 0 {
+		httpsServer := &http.Server{Addr: cfg.SslListenAddr, TLSConfig: tlsConfig}
+		httpServers = append(httpServers, httpsServer)
+		go func() {
+			if err := httpsServer.ListenAndServeTLS(certFile, keyFile); err != http.ErrServerClosed {
+				httpLog.Fatal("The HTTPS server stopped", "error", err)
+			}
+		}()
+		httpLog.Info("HTTPS server is listening", "addr", cfg.SslListenAddr)
 	}
-	httpsServer := &http.Server{Addr: cfg.SslListenAddr}
-	go func() {
-		log.Fatalln(httpsServer.ListenAndServeTLS("ssl.pub.pem", "ssl.priv.pem"))
-	}()
-	log.Println(" - HTTPS Server is listening on", cfg.SslListenAddr)
 }
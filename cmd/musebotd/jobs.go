@@ -0,0 +1,279 @@
+package main
+
+import (
+	"musebot"
+	"musebot/logging"
+	"musebot/provider"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var jobIdGenerator = make(chan int)
+
+type jobRegistry struct {
+	sync.Mutex
+	jobs    map[int]*jobEntry
+	givenUp bool // by shutdown, on whatever's still going; see waitUntilIdle
+}
+
+type jobEntry struct {
+	user   string
+	status musebot.JobStatus
+}
+
+var activeJobs = jobRegistry{jobs: make(map[int]*jobEntry)}
+
+func (jr *jobRegistry) start(jobId int, user string, z *zone, si musebot.SongInfo) {
+	jr.Lock()
+	defer jr.Unlock()
+
+	jr.jobs[jobId] = &jobEntry{user, musebot.JobStatus{strconv.Itoa(jobId), z.name, si, "", make(map[string]interface{})}}
+}
+
+func (jr *jobRegistry) startPlaylist(jobId int, user string, z *zone, name string) {
+	jr.Lock()
+	defer jr.Unlock()
+
+	jr.jobs[jobId] = &jobEntry{user, musebot.JobStatus{strconv.Itoa(jobId), z.name, musebot.SongInfo{}, name, make(map[string]interface{})}}
+}
+
+func (jr *jobRegistry) update(jobId int, m musebot.ProviderMessage) {
+	jr.Lock()
+	defer jr.Unlock()
+
+	if m.Type == "done" || m.Type == "error" {
+		delete(jr.jobs, jobId)
+		return
+	}
+	if j, ok := jr.jobs[jobId]; ok {
+		j.status.Progress[m.Type] = m.Content
+	}
+}
+
+// finish takes jobId off the list, so its song can be queued. If shutdown's
+// already given up on it, the job's been kept for next time or abandoned, so
+// it's left alone and mustn't be queued now as well.
+func (jr *jobRegistry) finish(jobId int) bool {
+	jr.Lock()
+	defer jr.Unlock()
+
+	if jr.givenUp {
+		return false
+	}
+	delete(jr.jobs, jobId)
+	return true
+}
+
+func (jr *jobRegistry) hasGivenUp() bool {
+	jr.Lock()
+	defer jr.Unlock()
+	return jr.givenUp
+}
+
+// fetching notes which of a playlist's songs its job is fetching now, or
+// that it's between songs if si is empty.
+func (jr *jobRegistry) fetching(jobId int, si musebot.SongInfo) {
+	jr.Lock()
+	defer jr.Unlock()
+
+	if j, ok := jr.jobs[jobId]; ok {
+		j.status.Song = si
+	}
+}
+
+// songs lists the songs still being fetched for z, each blamed on whoever
+// asked for it, so that they count towards the queue policy as if they'd
+// already been queued.
+func (jr *jobRegistry) songs(z *zone) []musebot.SongInfo {
+	jr.Lock()
+	defer jr.Unlock()
+
+	out := make([]musebot.SongInfo, 0)
+	for _, j := range jr.jobs {
+		if j.status.Zone != z.name {
+			continue
+		}
+		if len(j.status.Playlist) != 0 && len(j.status.Song.ProviderId) == 0 && len(j.status.Song.MusicUrl) == 0 {
+			continue
+		}
+		si := j.status.Song
+		si.QueueInfo = &musebot.QueuedSongInfo{Culprit: j.user}
+		out = append(out, si)
+	}
+	return out
+}
+
+// forget drops a job nobody was told about, because it didn't need to be one
+// after all.
+func (jr *jobRegistry) forget(jobId int) {
+	jr.Lock()
+	defer jr.Unlock()
+	delete(jr.jobs, jobId)
+}
+
+// forUser lists the jobs which are still going for user in z.
+func (jr *jobRegistry) forUser(user string, z *zone) []musebot.JobStatus {
+	jr.Lock()
+	defer jr.Unlock()
+
+	out := make([]musebot.JobStatus, 0)
+	for _, j := range jr.jobs {
+		if j.user != user || j.status.Zone != z.name {
+			continue
+		}
+		status := j.status
+		status.Progress = make(map[string]interface{})
+		for k, v := range j.status.Progress {
+			status.Progress[k] = v
+		}
+		out = append(out, status)
+	}
+	return out
+}
+
+// waitUntilIdle waits for every job to finish, or until it's given up on,
+// and returns any which were still going. Those won't queue anything after.
+func (jr *jobRegistry) waitUntilIdle(giveUp <-chan time.Time) []jobEntry {
+	for {
+		jr.Lock()
+		if len(jr.jobs) == 0 {
+			jr.Unlock()
+			return nil
+		}
+		select {
+		case <-giveUp:
+			jr.givenUp = true
+			out := make([]jobEntry, 0, len(jr.jobs))
+			for _, j := range jr.jobs {
+				out = append(out, *j)
+			}
+			jr.Unlock()
+			return out
+		default:
+		}
+		jr.Unlock()
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func startJobIdGenerator() {
+	go func(generatorPipe chan int) {
+		i := 0
+		for {
+			generatorPipe <- i
+			i = i + 1
+		}
+	}(jobIdGenerator)
+}
+
+func sendJobData(user string, jobId int, m musebot.ProviderMessage) {
+	if err, ok := m.Content.(error); ok {
+		// errors don't survive being turned into JSON
+		m.Content = err.Error()
+	}
+	activeJobs.update(jobId, m)
+	outputData := musebot.JobWebSocketApiResponse{JobId: strconv.Itoa(jobId), Data: m}
+	h.broadcastUser <- UserMessage{user: user, message: musebot.SystemMessage{musebot.EventJobData, outputData}}
+}
+
+// fetchAndQueue has si's provider fetch it, then adds it to z's queue on
+// behalf of whoever it was admitted for. It returns as soon as it knows
+// whether the song went straight onto the queue or has to be downloaded
+// first; in that case, it becomes a job and its progress is sent to them as
+// JOB_DATA. If it can't be queued, its admission is given back.
+func fetchAndQueue(z *zone, si *musebot.SongInfo, qa queueAdmission, log *logging.Logger) musebot.ApiResponse {
+	if isShuttingDown() {
+		qa.reject()
+		return wrapApiError(errShuttingDown)
+	}
+	if err := checkBlocklist(*si); err != nil {
+		qa.reject()
+		return wrapApiError(err)
+	}
+	user, jobId := qa.user, qa.jobId
+	si.QueueInfo = &musebot.QueuedSongInfo{Culprit: user}
+	if user != musebot.AutoplayCulprit {
+		z.autoplay.resume()
+	}
+
+	log = log.With("job", jobId, "zone", z.name)
+
+	provMessage := make(chan musebot.ProviderMessage)
+	go provider.Fetch(log.Fields(), si, provMessage)
+
+	firstResponse := make(chan musebot.ApiResponse)
+	go func(provMessage chan musebot.ProviderMessage, s *musebot.SongInfo, user string) {
+		hasQuit := false
+		var m musebot.ProviderMessage
+		for {
+			m = <-provMessage
+			if m.Type == "error" {
+				if !hasQuit {
+					qa.reject()
+					firstResponse <- wrapApiError(m.Content.(error))
+					return // done
+				}
+			} else if m.Type == "stages" {
+				if !hasQuit {
+					// tell them that we're AWESOME
+					if m.Content == 0 {
+						activeJobs.forget(jobId)
+						log.Debug("Adding to the queue", "title", s.Title)
+						if err := z.backend.Add(*s); err != nil {
+							log.Warn("Couldn't add to the queue", "title", s.Title, "error", err)
+							qa.reject()
+							firstResponse <- wrapApiError(err)
+						} else {
+							firstResponse <- musebot.QueuedApiResponse{*s}
+						}
+						return // done
+					} else {
+						activeJobs.start(jobId, user, z, *s)
+						firstResponse <- musebot.JobQueuedApiResponse{strconv.Itoa(jobId)}
+						hasQuit = true
+					}
+				}
+			} else if m.Type == "done" && hasQuit {
+				log.Debug("Adding to the queue", "title", s.Title)
+				if !activeJobs.finish(jobId) {
+					log.Info("Not queueing a song which shutdown gave up waiting for", "title", s.Title)
+					m = musebot.ProviderMessage{"error", errShuttingDown}
+				} else if err := z.backend.Add(*s); err != nil {
+					log.Warn("Couldn't add to the queue", "title", s.Title, "error", err)
+					m = musebot.ProviderMessage{"error", err}
+				}
+			}
+			if hasQuit {
+				if m.Type == "error" {
+					qa.reject()
+				}
+				sendJobData(user, jobId, m)
+				if m.Type == "done" || m.Type == "error" {
+					return
+				}
+			}
+		}
+	}(provMessage, si, user)
+
+	return <-firstResponse
+}
+
+// fetchSong has si's provider fetch it and waits until it's done, passing
+// on any progress it reports along the way.
+func fetchSong(si *musebot.SongInfo, progress func(musebot.ProviderMessage), log *logging.Logger) error {
+	provMessage := make(chan musebot.ProviderMessage)
+	go provider.Fetch(log.Fields(), si, provMessage)
+
+	for {
+		m := <-provMessage
+		switch m.Type {
+		case "error":
+			return m.Content.(error)
+		case "done":
+			return nil
+		default:
+			progress(m)
+		}
+	}
+}
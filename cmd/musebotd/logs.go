@@ -0,0 +1,30 @@
+package main
+
+import (
+	"musebot"
+	"musebot/logging"
+)
+
+// Each subsystem's logger, so that how much each says can be set on its own.
+var (
+	mainLog      = logging.New("main")
+	authLog      = logging.New("auth")
+	backendLog   = logging.New("backend")
+	providerLog  = logging.New("provider")
+	httpLog      = logging.New("http")
+	wsLog        = logging.New("ws")
+	jobsLog      = logging.New("jobs")
+	autoplayLog  = logging.New("autoplay")
+	scheduleLog  = logging.New("schedule")
+	partyLog     = logging.New("party")
+	historyLog   = logging.New("history")
+	playlistsLog = logging.New("playlists")
+	blocklistLog = logging.New("blocklist")
+)
+
+func setupLogging(config *musebot.JsonCfg) {
+	cfg := config.Logging
+	if err := logging.Configure(cfg.Format, cfg.Level, cfg.Levels); err != nil {
+		mainLog.Fatal("The logging configuration is wrong", "error", err)
+	}
+}
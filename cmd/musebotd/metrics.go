@@ -0,0 +1,46 @@
+package main
+
+import (
+	"musebot/metrics"
+	"net/http"
+)
+
+var (
+	wsConnections     = metrics.NewGauge("musebot_websocket_connections", "Clients following the hub, over websockets or SSE.")
+	hubDrops          = metrics.NewCounter("musebot_hub_dropped_connections_total", "Clients disconnected for not keeping up with events.")
+	loginFailures     = metrics.NewCounter("musebot_login_failures_total", "Logins refused for a bad username or password.")
+	queueLength       = metrics.NewGauge("musebot_queue_length", "Songs in each zone's queue, including the one playing.", "zone")
+	zonePlaying       = metrics.NewGauge("musebot_zone_playing", "Whether anything's playing in each zone.", "zone")
+	backendReconnects = metrics.NewCounter("musebot_backend_reconnects_total", "Times each zone's backend has had to reconnect.", "zone")
+)
+
+// collectZoneMetrics asks each zone how it's getting on, just before the
+// metrics are written.
+func collectZoneMetrics() {
+	for _, name := range zoneOrder {
+		z := zones[name]
+
+		if queue, err := z.backend.PlaybackQueue(); err == nil {
+			queueLength.Set(float64(len(queue)), name)
+		}
+
+		playing := 0.0
+		if _, isPlaying, err := z.backend.CurrentSong(); err == nil && isPlaying {
+			playing = 1
+		}
+		zonePlaying.Set(playing, name)
+	}
+}
+
+// registerMetricsHandler serves /metrics for Prometheus, which doesn't log
+// in; there's nothing there which needs hiding.
+func registerMetricsHandler() {
+	metrics.BeforeWrite(collectZoneMetrics)
+
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := metrics.Write(w); err != nil {
+			httpLog.Warn("Couldn't write metrics", "error", err)
+		}
+	})
+}
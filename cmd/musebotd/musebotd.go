@@ -3,44 +3,48 @@
 package main
 
 import (
-	"log"
 	"math/rand"
 	"musebot"
 	"time"
 )
 
 var config *musebot.JsonCfg
-var backendPipe chan string
 
 func main() {
-	log.Println("MuseBot is starting up!")
-	log.Println("--- COPYRIGHT 2012 LUKE GRANGER-BROWN. ALL RIGHTS RESERVED. ---")
-	log.Println()
+	mainLog.Info("MuseBot is starting up!")
+	mainLog.Info("--- COPYRIGHT 2012 LUKE GRANGER-BROWN. ALL RIGHTS RESERVED. ---")
 
 	// Seed PRNG
 	rand.Seed(time.Now().UnixNano())
 
 	// Load configuration
-	log.Println(" - Loading configuration...")
+	mainLog.Info("Loading configuration...")
 	config = &musebot.JsonCfg{}
 	err := config.LoadConfiguration()
 	if err != nil {
-		log.Fatalln(err)
+		mainLog.Fatal("Couldn't load the configuration", "error", err)
 	}
-	log.Println()
+	setupLogging(config)
 
 	musebot.CurrentAuthenticator = setupAuthenticator(config)
-	log.Println()
 
-	musebot.CurrentBackend, backendPipe = setupPlaybackBackend(config)
-	log.Println()
+	setupZones(config)
 
-	musebot.CurrentProviders = setupSongProviders(config)
-	log.Println()
+	musebot.SetCurrentProviders(setupSongProviders(config))
+	startProviderSupervisors(config)
+
+	setupHistory(config)
+	setupPlaylists(config)
+	setupQueuePolicy(config)
+	setupBlocklist(config)
+	setupAutoplay(config)
+	setupScheduler(config)
+	setupParty(config)
+	observeBackend(forgetRemovedSongs)
 
 	runHttpServer(config)
+	startScheduler()
+	resumePendingJobs(config)
 
-	for {
-		time.Sleep(60 * time.Second)
-	}
+	waitForShutdown(config)
 }
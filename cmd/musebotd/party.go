@@ -0,0 +1,319 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"musebot"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// party links zones together so that they all play whatever the leader's
+// playing. Followers have their queues made to match the leader's, start and
+// stop when it does, and get seeked back into step when they drift too far.
+// They're handed the very files the leader's playing, so only zones playing
+// from the same music directory as the leader can follow it.
+type party struct {
+	sync.Mutex
+
+	leader    *zone
+	followers map[*zone]bool
+	kick      chan bool // something's changed in the leader
+	done      chan bool // closed when the party's over
+
+	driftThreshold float64
+}
+
+var linkedZones = &party{driftThreshold: 2}
+
+var errPartyLeader = errors.New("The leader can't follow itself.")
+var errPartyMusicDir = errors.New("Only zones which play from the same music directory can be linked.")
+
+// how often followers are checked on when nothing's happened in the leader
+const partyCheckInterval = time.Second
+
+func setupParty(config *musebot.JsonCfg) {
+	if config.PartyDriftThreshold > 0 {
+		linkedZones.driftThreshold = config.PartyDriftThreshold
+	}
+	observeBackend(linkedZones.observe)
+}
+
+// leaderFor is where anything asked of z should really happen.
+func (p *party) leaderFor(z *zone) *zone {
+	p.Lock()
+	defer p.Unlock()
+	if p.followers[z] {
+		return p.leader
+	}
+	return z
+}
+
+// following says whether z is only doing what some other zone tells it to.
+func (p *party) following(z *zone) bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.followers[z]
+}
+
+func (p *party) status() musebot.PartyApiResponse {
+	p.Lock()
+	defer p.Unlock()
+	resp := musebot.PartyApiResponse{Zones: make([]string, 0, len(p.followers))}
+	if p.leader == nil {
+		return resp
+	}
+	resp.Leader = p.leader.name
+	for _, name := range zoneOrder {
+		if p.followers[zones[name]] {
+			resp.Zones = append(resp.Zones, name)
+		}
+	}
+	return resp
+}
+
+// sharesMusicDir says whether f can play the files z does.
+func sharesMusicDir(z *zone, f *zone) bool {
+	a, ok := z.backend.(musebot.MusicLibrary)
+	if !ok {
+		return false
+	}
+	b, ok := f.backend.(musebot.MusicLibrary)
+	return ok && filepath.Clean(a.MusicDir()) == filepath.Clean(b.MusicDir())
+}
+
+// link starts a party, ending whichever one was going on before.
+func (p *party) link(leader *zone, followers map[*zone]bool) error {
+	if followers[leader] {
+		return errPartyLeader
+	}
+	for f := range followers {
+		if !sharesMusicDir(leader, f) {
+			return errPartyMusicDir
+		}
+	}
+
+	p.Lock()
+	p.stop()
+	p.leader = leader
+	p.followers = followers
+	p.kick = make(chan bool, 1)
+	p.done = make(chan bool)
+	go p.run(leader, followers, p.kick, p.done)
+	p.Unlock()
+
+	p.announce()
+	return nil
+}
+
+func (p *party) unlink() {
+	p.Lock()
+	p.stop()
+	p.Unlock()
+
+	p.announce()
+}
+
+// stop ends the party. p must be locked.
+func (p *party) stop() {
+	if p.done != nil {
+		close(p.done)
+	}
+	p.leader = nil
+	p.followers = nil
+	p.kick = nil
+	p.done = nil
+}
+
+func (p *party) announce() {
+	status := p.status()
+	partyLog.Info("Party changed", "leader", status.Leader, "zones", strings.Join(status.Zones, ","))
+	h.broadcast <- ZoneMessage{"", musebot.SystemMessage{musebot.EventPartyChanged, musebot.PartyChangedEvent{status.Leader, status.Zones}}}
+}
+
+// observe gets followers caught up straight away when the leader's queue or
+// playback changes, rather than waiting for the next check.
+func (p *party) observe(z *zone, m musebot.BackendMessage) {
+	switch m.Type {
+	case musebot.EventPlaylistAdd, musebot.EventPlaylistRemove, musebot.EventReloadPlaylist, musebot.EventSongChanged, musebot.EventPlaybackStateChange, musebot.EventSeeked:
+	default:
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if z != p.leader {
+		return
+	}
+	select {
+	case p.kick <- true:
+	default: // already on its way
+	}
+}
+
+func (p *party) run(leader *zone, followers map[*zone]bool, kick chan bool, done chan bool) {
+	ticker := time.NewTicker(partyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-kick:
+		case <-ticker.C:
+		}
+
+		queue, err := leader.backend.PlaybackQueue()
+		if err != nil {
+			continue
+		}
+		current, isPlaying, err := leader.backend.CurrentSong()
+		if err != nil {
+			continue
+		}
+		readAt := time.Now()
+		for f := range followers {
+			p.syncQueue(f, queue)
+			p.syncPlayback(f, leaderNow(current, readAt), isPlaying)
+		}
+	}
+}
+
+// syncQueue makes f's queue match the leader's. The leader's queue only ever
+// grows at the end, so anything in f's which isn't next in line has to go,
+// and then whatever's missing gets added after it.
+func (p *party) syncQueue(f *zone, queue []musebot.SongInfo) {
+	theirs, err := f.backend.PlaybackQueue()
+	if err != nil {
+		return
+	}
+
+	matched := 0
+	for _, si := range theirs {
+		if matched < len(queue) && partySongKey(si) == partySongKey(queue[matched]) {
+			matched++
+			continue
+		}
+		if err := f.backend.Remove(si); err != nil {
+			partyLog.Warn("Couldn't remove a song", "zone", f.name, "title", si.Title, "error", err)
+			return
+		}
+	}
+
+	// playing is up to syncPlayback, which goes by what the leader's doing
+	for _, si := range queue[matched:] {
+		if err := f.backend.Enqueue(mirroredSong(si)); err != nil {
+			partyLog.Warn("Couldn't add a song", "zone", f.name, "title", si.Title, "error", err)
+			return
+		}
+	}
+}
+
+// syncPlayback starts, pauses or stops f along with the leader, and seeks it
+// if it's drifted too far from where the leader is.
+func (p *party) syncPlayback(f *zone, current musebot.SongInfo, isPlaying bool) {
+	theirs, theyArePlaying, err := f.backend.CurrentSong()
+	if err != nil {
+		return
+	}
+
+	if !isPlaying {
+		if theyArePlaying {
+			f.backend.Stop()
+		}
+		return
+	}
+
+	// quiet hours still apply to each room on its own
+	if len(schedules.quiet(f)) != 0 {
+		return
+	}
+
+	if !theyArePlaying || theirs.PlaybackInfo.State != current.PlaybackInfo.State {
+		if current.PlaybackInfo.State == "pause" {
+			f.backend.Pause()
+		} else {
+			f.backend.Play()
+		}
+		return
+	}
+
+	if partySongKey(theirs) != partySongKey(current) {
+		return // their queue's still being sorted out
+	}
+	if math.Abs(theirs.PlaybackInfo.Position-current.PlaybackInfo.Position) > p.driftThreshold {
+		if err := f.backend.Seek(theirs, current.PlaybackInfo.Position); err != nil {
+			partyLog.Warn("Couldn't seek", "zone", f.name, "error", err)
+		}
+	}
+}
+
+// leaderNow is where the leader's got to by now, given it was at current
+// when it was asked at readAt. Syncing each follower takes a while, so the
+// later ones would otherwise be dragged backwards.
+func leaderNow(current musebot.SongInfo, readAt time.Time) musebot.SongInfo {
+	if current.PlaybackInfo == nil || current.PlaybackInfo.State != "play" {
+		return current
+	}
+	info := *current.PlaybackInfo
+	info.Position += time.Since(readAt).Seconds()
+	current.PlaybackInfo = &info
+	return current
+}
+
+// partySongKey identifies a song across backends, which each give it an Id
+// and location of their own.
+func partySongKey(si musebot.SongInfo) string {
+	providerName, _ := si.ProviderName.(string)
+	if len(si.ProviderId) != 0 {
+		return providerName + ":" + si.ProviderId
+	}
+	return strings.Join([]string{providerName, si.Artist, si.Album, si.Title, strconv.Itoa(si.Length)}, "\x00")
+}
+
+// mirroredSong is si, ready to be added to some other backend which shares
+// its music directory.
+func mirroredSong(si musebot.SongInfo) musebot.SongInfo {
+	si.Id = ""
+	si.MusicUrl = strings.TrimPrefix(si.MusicUrl, "file://")
+	si.PlaybackInfo = nil
+	return si
+}
+
+func registerPartyApi() {
+	handleApi("/api/party/", "party", func(ar *apiRequest) musebot.ApiResponse {
+		return linkedZones.status()
+	})
+
+	// the leader's the zone named, and everyone in "zones" follows it
+	handleAdminApi("/api/party/link/", "party_link", func(ar *apiRequest) musebot.ApiResponse {
+		leader, err := lookupZone(ar.get("zone"))
+		if err != nil {
+			return wrapApiError(err)
+		}
+		following, err := parseZoneList(ar.get("zones"))
+		if err != nil {
+			return wrapApiError(err)
+		}
+		if following == nil {
+			return wrapApiError(errors.New("'zones' must list the zones to link."))
+		}
+
+		followers := make(map[*zone]bool)
+		for name := range following {
+			followers[zones[name]] = true
+		}
+		if err := linkedZones.link(leader, followers); err != nil {
+			return wrapApiError(err)
+		}
+		return linkedZones.status()
+	})
+
+	handleAdminApi("/api/party/unlink/", "party_unlink", func(ar *apiRequest) musebot.ApiResponse {
+		linkedZones.unlink()
+		return linkedZones.status()
+	})
+}
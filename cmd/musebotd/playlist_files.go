@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"musebot"
+	"musebot/playlistfile"
+	"musebot/provider"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// biggest playlist file we're prepared to read
+const maxPlaylistFileSize = 4 * 1024 * 1024
+
+var errImportNoMatch = errors.New("Couldn't find that song anywhere.")
+
+// playlistFileName makes name safe to suggest as a file name.
+func playlistFileName(name string, format string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || r < ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+	if len(name) == 0 {
+		name = "playlist"
+	}
+	return name + "." + format
+}
+
+// inMusicDir is whether path is somewhere in z's music library. Those are the
+// only local files anyone gets to queue; the rest of the disk is none of
+// their business.
+func inMusicDir(z *zone, path string) bool {
+	lib, ok := z.backend.(musebot.MusicLibrary)
+	if !ok || !filepath.IsAbs(path) {
+		return false
+	}
+	dir := filepath.Clean(lib.MusicDir())
+	return strings.HasPrefix(filepath.Clean(path), dir+string(filepath.Separator))
+}
+
+// resolveImported works out where we can get an imported song from: the
+// provider it says it came from, a file in z's music library, or failing that
+// whatever a search for it turns up.
+func resolveImported(z *zone, item musebot.PlaylistItem) (musebot.PlaylistItem, error) {
+	if item.HasProvider() {
+		if si, err := songFromProvider(item.ProviderName, item.ProviderId); err == nil {
+			return musebot.PlaylistItemFromSongInfo(si), nil
+		}
+	}
+
+	// anywhere else is treated as if it doesn't exist, so nobody can go
+	// looking for files they shouldn't
+	if inMusicDir(z, item.Location) {
+		item.Location = filepath.Clean(item.Location)
+		if fi, err := os.Stat(item.Location); err == nil && fi.Mode().IsRegular() {
+			item.ProviderName, item.ProviderId = "", ""
+			return item, nil
+		}
+	}
+
+	if len(item.Title) == 0 {
+		return item, errImportNoMatch
+	}
+	q := musebot.SearchQuery{Artist: item.Artist, Title: item.Title, Limit: 1}
+	results, _, _ := provider.FederatedSearch(healthyProviders(), q, searchTimeout, nil)
+	if len(results) == 0 {
+		return item, errImportNoMatch
+	}
+
+	providerName, providerId := "", ""
+	for name, id := range results[0].AvailableFrom {
+		providerName, providerId = name, id
+		if name == config.DefaultProvider {
+			break
+		}
+	}
+	si, err := songFromProvider(providerName, providerId)
+	if err != nil {
+		return item, err
+	}
+	return musebot.PlaylistItemFromSongInfo(si), nil
+}
+
+func readPlaylistFile(r *http.Request) ([]byte, error) {
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, errors.New("You must upload the playlist as 'file'!")
+		}
+		defer f.Close()
+		body = f
+	}
+	return ioutil.ReadAll(io.LimitReader(body, maxPlaylistFileSize))
+}
+
+func registerPlaylistFileApi() {
+	http.HandleFunc("/api/export/", func(w http.ResponseWriter, r *http.Request) {
+		sess := getSession(r)
+		if !enforceLoggedIn(sess, w) {
+			return
+		}
+		r.ParseForm()
+		ar := newApiRequest(r.Form, sess, requestId(w, r), httpLog)
+
+		format := playlistfile.Normalise(ar.get("format"))
+		if len(format) == 0 {
+			writeApiResponse(w, wrapApiError(playlistfile.ErrUnknownFormat))
+			return
+		}
+
+		name := "Queue"
+		items := make([]musebot.PlaylistItem, 0)
+		if ar.get("source") == "playlist" {
+			if playlistStore == nil {
+				writeApiResponse(w, wrapApiError(errPlaylistsDisabled))
+				return
+			}
+			pl, err := playlistStore.Get(playlistOwner(ar), ar.get("name"))
+			if err != nil {
+				writeApiResponse(w, wrapApiError(err))
+				return
+			}
+			name, items = pl.Name, pl.Items
+		} else {
+			z, err := ar.zone()
+			if err != nil {
+				writeApiResponse(w, wrapApiError(err))
+				return
+			}
+			name = "Queue (" + z.name + ")"
+			queue, err := z.backend.PlaybackQueue()
+			if err != nil {
+				writeApiResponse(w, wrapApiError(err))
+				return
+			}
+			for _, si := range queue {
+				items = append(items, musebot.PlaylistItemFromSongInfo(si))
+			}
+		}
+
+		b, err := playlistfile.Encode(format, name, items)
+		if err != nil {
+			writeApiResponse(w, wrapApiError(err))
+			return
+		}
+		w.Header().Set("Content-Type", playlistfile.Formats[format])
+		w.Header().Set("Content-Disposition", `attachment; filename="`+playlistFileName(name, format)+`"`)
+		w.Write(b)
+	})
+
+	http.HandleFunc("/api/import/", func(w http.ResponseWriter, r *http.Request) {
+		sess := getSession(r)
+		if !enforceLoggedIn(sess, w) {
+			return
+		}
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			writeApiResponse(w, wrapApiError(errors.New("You must POST the playlist to import!")))
+			return
+		}
+
+		b, err := readPlaylistFile(r)
+		if err != nil {
+			writeApiResponse(w, wrapApiError(err))
+			return
+		}
+		ar := newApiRequest(r.URL.Query(), sess, requestId(w, r), httpLog)
+		if r.MultipartForm != nil {
+			for k, v := range r.MultipartForm.Value {
+				ar.params[k] = v
+			}
+		}
+
+		format := ar.get("format")
+		if len(format) != 0 && len(playlistfile.Normalise(format)) == 0 {
+			writeApiResponse(w, wrapApiError(playlistfile.ErrUnknownFormat))
+			return
+		}
+		into := ar.get("into")
+		if into == "playlist" && playlistStore == nil {
+			writeApiResponse(w, wrapApiError(errPlaylistsDisabled))
+			return
+		}
+		z, err := ar.zone()
+		if err != nil {
+			writeApiResponse(w, wrapApiError(err))
+			return
+		}
+
+		fileName, entries, err := playlistfile.Decode(format, b)
+		if err != nil {
+			writeApiResponse(w, wrapApiError(errors.New("Couldn't read that playlist: "+err.Error())))
+			return
+		}
+		name := ar.get("name")
+		if len(name) == 0 {
+			name = fileName
+		}
+		if len(name) == 0 {
+			name = "Imported playlist"
+		}
+
+		resp := musebot.ImportApiResponse{Failures: make([]musebot.ImportFailure, 0)}
+		items := make([]musebot.PlaylistItem, 0, len(entries))
+		for i, entry := range entries {
+			item, err := resolveImported(z, entry)
+			if err != nil {
+				resp.Failures = append(resp.Failures, musebot.ImportFailure{i, entry, err.Error()})
+				continue
+			}
+			items = append(items, item)
+		}
+		resp.Imported = len(items)
+
+		if into == "playlist" {
+			pl, err := playlistStore.Replace(ar.user(), name, items)
+			if err != nil {
+				writeApiResponse(w, wrapApiError(err))
+				return
+			}
+			resp.Playlist = &pl
+		} else if len(items) != 0 {
+			switch queued := queuePlaylist(z, musebot.SavedPlaylist{Name: name, Items: items}, ar.user(), ar.isAdmin(), ar.log).(type) {
+			case musebot.JobQueuedApiResponse:
+				resp.JobId = queued.JobId
+			default:
+				writeApiResponse(w, queued)
+				return
+			}
+		}
+		writeApiResponse(w, resp)
+	})
+}
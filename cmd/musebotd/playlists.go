@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"musebot"
+	"musebot/logging"
+	"musebot/playlists"
+	"strconv"
+	"time"
+)
+
+var playlistStore *playlists.Store
+
+var (
+	errPlaylistsDisabled = errors.New("Saved playlists aren't enabled on this server.")
+	errEmptyPlaylist     = errors.New("There's nothing on that playlist to queue!")
+	errNotInMusicDir     = errors.New("Only songs in the music library can be queued from a file.")
+)
+
+func setupPlaylists(cfg *musebot.JsonCfg) {
+	if len(cfg.PlaylistFile) == 0 {
+		playlistsLog.Info("No PlaylistFile configured, so playlists can't be saved.")
+		return
+	}
+
+	playlistsLog.Info("Loading saved playlists", "file", cfg.PlaylistFile)
+	var err error
+	playlistStore, err = playlists.Open(cfg.PlaylistFile)
+	if err != nil {
+		playlistsLog.Fatal("Couldn't open the playlist file", "file", cfg.PlaylistFile, "error", err)
+	}
+}
+
+// songFromProvider asks a provider for everything it knows about one of its
+// songs.
+func songFromProvider(providerName string, providerId string) (musebot.SongInfo, error) {
+	si := musebot.SongInfo{ProviderName: providerName, ProviderId: providerId}
+	p, err := lookupProvider(providerName)
+	if err != nil {
+		return si, err
+	}
+	si.Provider = p
+	err = p.UpdateSongInfo(&si)
+	return si, err
+}
+
+func describePlaylistItem(item musebot.PlaylistItem) string {
+	if len(item.Title) == 0 {
+		if !item.HasProvider() {
+			return item.Location
+		}
+		return item.ProviderName + ":" + item.ProviderId
+	}
+	if len(item.Artist) == 0 {
+		return item.Title
+	}
+	return item.Artist + " - " + item.Title
+}
+
+// queuePlaylist fetches and queues every song on pl in order, as a single
+// job. Songs which can't be queued, or which break the queue policy, are
+// skipped and reported at the end.
+func queuePlaylist(z *zone, pl musebot.SavedPlaylist, user string, admin bool, log *logging.Logger) musebot.ApiResponse {
+	if len(pl.Items) == 0 {
+		return wrapApiError(errEmptyPlaylist)
+	}
+	if isShuttingDown() {
+		return wrapApiError(errShuttingDown)
+	}
+	if !admin {
+		if err := checkQuietHours(z); err != nil {
+			return wrapApiError(err)
+		}
+
+		// the whole playlist only counts once towards the cooldown
+		admissionLock.Lock()
+		now := time.Now()
+		if err := queuePolicy.CheckCooldown(user, now); err != nil {
+			admissionLock.Unlock()
+			return wrapApiError(err)
+		}
+		queuePolicy.Queued(user, now)
+		admissionLock.Unlock()
+	}
+
+	jobId := <-jobIdGenerator
+	activeJobs.startPlaylist(jobId, user, z, pl.Name)
+	z.autoplay.resume()
+	log = log.With("job", jobId, "zone", z.name, "playlist", pl.Name)
+	log.Info("Queueing a playlist", "songs", len(pl.Items))
+
+	go func() {
+		failures := make([]string, 0)
+		sendJobData(user, jobId, musebot.ProviderMessage{"stages", len(pl.Items)})
+
+		for i, item := range pl.Items {
+			if activeJobs.hasGivenUp() {
+				log.Warn("Giving up on the rest of a playlist, since we're shutting down", "remaining", len(pl.Items)-i)
+				break
+			}
+			sendJobData(user, jobId, musebot.ProviderMessage{"current_stage", i + 1})
+			sendJobData(user, jobId, musebot.ProviderMessage{"current_stage_description", "Fetching " + describePlaylistItem(item) + "..."})
+
+			err := queuePlaylistItem(z, jobId, item, user, admin, func(m musebot.ProviderMessage) {
+				if m.Type == "length" || m.Type == "downloaded" {
+					sendJobData(user, jobId, m)
+				}
+			}, log)
+			if err != nil {
+				log.Warn("Couldn't queue a song from the playlist", "song", describePlaylistItem(item), "error", err)
+				failures = append(failures, describePlaylistItem(item)+": "+err.Error())
+				sendJobData(user, jobId, musebot.ProviderMessage{"failures", append([]string{}, failures...)})
+			}
+		}
+
+		log.Info("Finished queueing a playlist", "failures", len(failures))
+		if len(failures) == len(pl.Items) {
+			sendJobData(user, jobId, musebot.ProviderMessage{"error", errors.New("None of the songs on " + pl.Name + " could be queued.")})
+		} else {
+			sendJobData(user, jobId, musebot.ProviderMessage{"done", nil})
+		}
+	}()
+
+	return musebot.JobQueuedApiResponse{strconv.Itoa(jobId)}
+}
+
+func queuePlaylistItem(z *zone, jobId int, item musebot.PlaylistItem, user string, admin bool, progress func(musebot.ProviderMessage), log *logging.Logger) error {
+	var si musebot.SongInfo
+	if item.HasProvider() {
+		var err error
+		if si, err = songFromProvider(item.ProviderName, item.ProviderId); err != nil {
+			return err
+		}
+	} else {
+		si = musebot.SongInfo{
+			Title:        item.Title,
+			Artist:       item.Artist,
+			Album:        item.Album,
+			Length:       item.Length,
+			MusicUrl:     item.Location,
+			ProviderName: "<<LOCAL>>",
+		}
+	}
+	si.QueueInfo = &musebot.QueuedSongInfo{Culprit: user}
+
+	if err := checkBlocklist(si); err != nil {
+		return err
+	}
+	// like any other song, it counts towards the queue policy until it's queued
+	admissionLock.Lock()
+	if !admin {
+		if err := checkQueuePolicy(z, si, user, time.Now()); err != nil {
+			admissionLock.Unlock()
+			return err
+		}
+	}
+	activeJobs.fetching(jobId, si)
+	admissionLock.Unlock()
+	defer activeJobs.fetching(jobId, musebot.SongInfo{})
+
+	if !item.HasProvider() {
+		if !inMusicDir(z, item.Location) {
+			return errNotInMusicDir
+		}
+		return z.backend.Add(si)
+	}
+
+	if err := fetchSong(&si, progress, log); err != nil {
+		return err
+	}
+	return z.backend.Add(si)
+}
+
+// playlistApi wraps API methods which need saved playlists turned on.
+func playlistApi(fn apiHandler) apiHandler {
+	return func(ar *apiRequest) musebot.ApiResponse {
+		if playlistStore == nil {
+			return wrapApiError(errPlaylistsDisabled)
+		}
+		return fn(ar)
+	}
+}
+
+// playlistOwner is whose playlist is being looked at: anybody can look at
+// and queue anybody else's playlists, but not change them.
+func playlistOwner(ar *apiRequest) string {
+	if owner := ar.get("owner"); len(owner) != 0 {
+		return owner
+	}
+	return ar.user()
+}
+
+func playlistResponse(pl musebot.SavedPlaylist, err error) musebot.ApiResponse {
+	if err != nil {
+		return wrapApiError(err)
+	}
+	return musebot.SavedPlaylistApiResponse{pl}
+}
+
+func registerPlaylistApi() {
+	handleApi("/api/playlists/", "playlists", playlistApi(func(ar *apiRequest) musebot.ApiResponse {
+		return musebot.SavedPlaylistsApiResponse{playlistStore.List(playlistOwner(ar))}
+	}))
+
+	handleApi("/api/playlist/", "playlist", playlistApi(func(ar *apiRequest) musebot.ApiResponse {
+		return playlistResponse(playlistStore.Get(playlistOwner(ar), ar.get("name")))
+	}))
+
+	handleApi("/api/playlist/create/", "playlist_create", playlistApi(func(ar *apiRequest) musebot.ApiResponse {
+		return playlistResponse(playlistStore.Create(ar.user(), ar.get("name")))
+	}))
+
+	handleApi("/api/playlist/rename/", "playlist_rename", playlistApi(func(ar *apiRequest) musebot.ApiResponse {
+		return playlistResponse(playlistStore.Rename(ar.user(), ar.get("name"), ar.get("new_name")))
+	}))
+
+	handleApi("/api/playlist/delete/", "playlist_delete", playlistApi(func(ar *apiRequest) musebot.ApiResponse {
+		if err := playlistStore.Delete(ar.user(), ar.get("name")); err != nil {
+			return wrapApiError(err)
+		}
+		return musebot.PlaylistDeletedApiResponse{ar.get("name")}
+	}))
+
+	handleApi("/api/playlist/add/", "playlist_add", playlistApi(func(ar *apiRequest) musebot.ApiResponse {
+		si, err := songFromProvider(ar.get("provider"), ar.get("provider_id"))
+		if err != nil {
+			return wrapApiError(err)
+		}
+		position, err := ar.getInt("position", -1) // the end
+		if err != nil {
+			return wrapApiError(err)
+		}
+		return playlistResponse(playlistStore.AddItem(ar.user(), ar.get("name"), musebot.PlaylistItemFromSongInfo(si), position))
+	}))
+
+	handleApi("/api/playlist/remove/", "playlist_remove", playlistApi(func(ar *apiRequest) musebot.ApiResponse {
+		position, err := ar.getInt("position", -1)
+		if err != nil {
+			return wrapApiError(err)
+		}
+		return playlistResponse(playlistStore.RemoveItem(ar.user(), ar.get("name"), position))
+	}))
+
+	handleApi("/api/playlist/move/", "playlist_move", playlistApi(func(ar *apiRequest) musebot.ApiResponse {
+		from, err := ar.getInt("from", -1)
+		if err != nil {
+			return wrapApiError(err)
+		}
+		to, err := ar.getInt("to", -1)
+		if err != nil {
+			return wrapApiError(err)
+		}
+		return playlistResponse(playlistStore.MoveItem(ar.user(), ar.get("name"), from, to))
+	}))
+
+	handleApi("/api/playlist/queue/", "playlist_queue", playlistApi(func(ar *apiRequest) musebot.ApiResponse {
+		z, err := ar.zone()
+		if err != nil {
+			return wrapApiError(err)
+		}
+		pl, err := playlistStore.Get(playlistOwner(ar), ar.get("name"))
+		if err != nil {
+			return wrapApiError(err)
+		}
+		return queuePlaylist(z, pl, ar.user(), ar.isAdmin(), ar.log)
+	}))
+}
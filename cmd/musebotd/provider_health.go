@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"musebot"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var errProviderUnavailable = errors.New("That provider is currently unavailable.")
+
+type providerHealthRegistry struct {
+	sync.Mutex
+	health map[string]*musebot.ProviderHealth
+}
+
+var providerHealth = providerHealthRegistry{health: make(map[string]*musebot.ProviderHealth)}
+
+func (r *providerHealthRegistry) record(name string, err error, nextRetry time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	ph, ok := r.health[name]
+	if !ok {
+		ph = &musebot.ProviderHealth{}
+		r.health[name] = ph
+	}
+	ph.LastChecked = time.Now()
+	if err == nil {
+		ph.Healthy = true
+		ph.LastError = ""
+		ph.ConsecutiveFailures = 0
+		ph.NextRetry = nil
+	} else {
+		ph.Healthy = false
+		ph.LastError = err.Error()
+		ph.ConsecutiveFailures++
+		ph.NextRetry = &nextRetry
+	}
+}
+
+func (r *providerHealthRegistry) isHealthy(name string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	ph, ok := r.health[name]
+	return ok && ph.Healthy
+}
+
+func (r *providerHealthRegistry) snapshot() map[string]musebot.ProviderHealth {
+	r.Lock()
+	defer r.Unlock()
+
+	out := make(map[string]musebot.ProviderHealth)
+	for name, ph := range r.health {
+		out[name] = *ph
+	}
+	return out
+}
+
+// healthyProviders is musebot.CurrentProviders(), minus anything that isn't
+// working right now.
+func healthyProviders() musebot.Providers {
+	out := make(musebot.Providers)
+	for name, p := range musebot.CurrentProviders() {
+		if providerHealth.isHealthy(name) {
+			out[name] = p
+		}
+	}
+	return out
+}
+
+// lookupProvider finds a provider by name, refusing ones which are down.
+func lookupProvider(name string) (musebot.Provider, error) {
+	p, ok := musebot.CurrentProvider(name)
+	if !ok {
+		return nil, errors.New("Provider not found")
+	}
+	if !providerHealth.isHealthy(name) {
+		return nil, errProviderUnavailable
+	}
+	return p, nil
+}
+
+// pickDefaultProvider returns the configured default provider if it's up, or
+// any healthy provider otherwise.
+func pickDefaultProvider() (musebot.Provider, error) {
+	if p, err := lookupProvider(config.DefaultProvider); err == nil {
+		return p, nil
+	}
+	for _, p := range healthyProviders() {
+		return p, nil
+	}
+	return nil, errors.New("No providers are available right now.")
+}
+
+// guardedProviderCall stops a provider which gets confused by what it's been
+// sent from taking the whole daemon down with it.
+func guardedProviderCall(f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("provider panicked: %v", r)
+		}
+	}()
+	return f()
+}
+
+func checkProvider(p musebot.Provider) error {
+	hc, ok := p.(musebot.HealthChecker)
+	if !ok {
+		return nil
+	}
+	return guardedProviderCall(hc.HealthCheck)
+}
+
+const initialProviderBackoff = 10 * time.Second
+
+func minDuration(a time.Duration, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// freshProvider sets up and checks a new instance of p. Setting up a
+// provider changes it, so that's never done to the one in use.
+func freshProvider(p musebot.Provider, cfg map[string]string) (musebot.Provider, error) {
+	fresh := reflect.New(reflect.TypeOf(p).Elem()).Interface().(musebot.Provider)
+	err := guardedProviderCall(func() error { return fresh.Setup(cfg) })
+	if err == nil {
+		err = checkProvider(fresh)
+	}
+	return fresh, err
+}
+
+// superviseProvider keeps an eye on a single provider. Healthy providers are
+// health checked every interval, as they are. Broken ones are rebuilt from
+// scratch, backing off exponentially up to maxBackoff between attempts, and
+// the new instance replaces the broken one once it works.
+func superviseProvider(name string, p musebot.Provider, cfg map[string]string, interval time.Duration, maxBackoff time.Duration) {
+	backoff := minDuration(initialProviderBackoff, maxBackoff)
+	healthy := providerHealth.isHealthy(name)
+
+	for {
+		if healthy {
+			time.Sleep(interval)
+			current, _ := musebot.CurrentProvider(name)
+			err := checkProvider(current)
+			if err == nil {
+				providerHealth.record(name, nil, time.Time{})
+				continue
+			}
+			providerLog.Warn("Provider failed its health check", "provider", name, "error", err)
+			healthy = false
+			backoff = minDuration(initialProviderBackoff, maxBackoff)
+			providerHealth.record(name, err, time.Now().Add(backoff))
+			continue
+		}
+
+		time.Sleep(backoff)
+		fresh, err := freshProvider(p, cfg)
+		if err != nil {
+			backoff = minDuration(backoff*2, maxBackoff)
+			providerLog.Warn("Provider is still unavailable", "provider", name, "error", err, "retry_in", backoff)
+			providerHealth.record(name, err, time.Now().Add(backoff))
+			continue
+		}
+
+		musebot.ReplaceCurrentProvider(name, fresh)
+		providerLog.Info("Provider is back!", "provider", name)
+		providerHealth.record(name, nil, time.Time{})
+		healthy = true
+	}
+}
+
+func startProviderSupervisors(cfg *musebot.JsonCfg) {
+	interval := time.Duration(cfg.ProviderCheckInterval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	maxBackoff := time.Duration(cfg.ProviderRetryMax) * time.Second
+	if maxBackoff <= 0 {
+		maxBackoff = 10 * time.Minute
+	}
+
+	for name, p := range musebot.CurrentProviders() {
+		go superviseProvider(name, p, cfg.ProviderBackendConfig[name], interval, maxBackoff)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"musebot"
+	"musebot/policy"
+	"sync"
+	"time"
+)
+
+var queuePolicy *policy.Engine
+
+func setupQueuePolicy(cfg *musebot.JsonCfg) {
+	queuePolicy = policy.New(cfg.QueuePolicy)
+}
+
+// checkQueuePolicy sees whether user may queue si in z, going by what's
+// queued there (or will be, once it's downloaded) and what it's played
+// lately.
+func checkQueuePolicy(z *zone, si musebot.SongInfo, user string, now time.Time) error {
+	queue, err := z.backend.PlaybackQueue()
+	if err != nil {
+		return err
+	}
+	queue = append(queue, activeJobs.songs(z)...)
+
+	recent := make([]musebot.HistoryEntry, 0)
+	if historyStore != nil && queuePolicy.RepeatWindow() > 0 {
+		for _, e := range historyStore.Since(now.Add(-queuePolicy.RepeatWindow())) {
+			if e.Zone == z.name {
+				recent = append(recent, e)
+			}
+		}
+	}
+	return queuePolicy.Check(si, user, queue, recent, now)
+}
+
+// admissions are checked and recorded one at a time, so that nobody can get
+// round the queue policy by asking for several songs at once
+var admissionLock sync.Mutex
+
+// queueAdmission is a song's place in the queue policy, which it holds from
+// being admitted until it's been queued or has failed to be.
+type queueAdmission struct {
+	jobId    int
+	user     string
+	cooldown time.Time // when the user's cooldown was started for it, if it was
+}
+
+// admitUnpoliced admits si without applying the queue policy to it, for
+// songs queued by administrators, or by musebot itself.
+func admitUnpoliced(z *zone, si musebot.SongInfo, user string) queueAdmission {
+	jobId := <-jobIdGenerator
+	activeJobs.start(jobId, user, z, si)
+	return queueAdmission{jobId, user, time.Time{}}
+}
+
+// reject gives back the place si was holding, and the cooldown it cost, once
+// it turns out it can't be queued after all.
+func (qa queueAdmission) reject() {
+	activeJobs.forget(qa.jobId)
+	if !qa.cooldown.IsZero() {
+		queuePolicy.Refund(qa.user, qa.cooldown)
+	}
+}
+
+// admitToQueue applies the queue policy to someone asking for si to be
+// queued and, if it's allowed, starts their cooldown and counts si as queued
+// until it has been. Administrators can queue whatever they like.
+func admitToQueue(z *zone, si musebot.SongInfo, ar *apiRequest) (queueAdmission, error) {
+	if ar.isAdmin() {
+		return admitUnpoliced(z, si, ar.user()), nil
+	}
+	if err := checkQuietHours(z); err != nil {
+		return queueAdmission{}, err
+	}
+	if err := checkBlocklist(si); err != nil {
+		return queueAdmission{}, err
+	}
+
+	admissionLock.Lock()
+	defer admissionLock.Unlock()
+
+	now := time.Now()
+	if err := queuePolicy.CheckCooldown(ar.user(), now); err != nil {
+		return queueAdmission{}, err
+	}
+	if err := checkQueuePolicy(z, si, ar.user(), now); err != nil {
+		return queueAdmission{}, err
+	}
+	queuePolicy.Queued(ar.user(), now)
+	qa := admitUnpoliced(z, si, ar.user())
+	qa.cooldown = now
+	return qa, nil
+}
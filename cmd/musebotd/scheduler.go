@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"musebot"
+	"musebot/schedule"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type scheduleRule struct {
+	musebot.ScheduleRuleCfg
+	spec  *schedule.Spec
+	zones map[string]bool // nil if it applies everywhere
+}
+
+func (r scheduleRule) appliesTo(z *zone) bool {
+	return r.zones == nil || r.zones[z.name]
+}
+
+// zoneSchedule is what the schedule's done to a zone.
+type zoneSchedule struct {
+	quietRule      string // the rule keeping things quiet, if there is one
+	pausedForQuiet bool
+	volumeCap      int
+	volumeBefore   int // what the volume was before we capped it, or -1
+	fallback       string
+}
+
+// scheduler checks the schedule every minute, and keeps each zone's backend
+// and autoplay in line with whichever rules are in force.
+type scheduler struct {
+	sync.Mutex
+	rules  []scheduleRule
+	active map[string]bool
+	zones  map[*zone]*zoneSchedule
+}
+
+var schedules *scheduler
+
+func setupScheduler(cfg *musebot.JsonCfg) {
+	if len(cfg.Schedule) == 0 {
+		return
+	}
+
+	s := &scheduler{active: make(map[string]bool), zones: make(map[*zone]*zoneSchedule)}
+	for _, z := range zones {
+		s.zones[z] = &zoneSchedule{volumeBefore: -1}
+	}
+	for i, rc := range cfg.Schedule {
+		if len(rc.Name) == 0 {
+			rc.Name = "Rule " + strconv.Itoa(i+1)
+		}
+		spec, err := schedule.Parse(rc.When)
+		if err != nil {
+			scheduleLog.Fatal("Schedule rule has a bad When", "rule", rc.Name, "error", err)
+		}
+		if len(rc.FallbackPlaylist) != 0 && !cfg.Autoplay.Enabled {
+			scheduleLog.Warn("Schedule rule sets a fallback playlist, but autoplay is turned off.", "rule", rc.Name)
+		}
+
+		r := scheduleRule{rc, spec, nil}
+		if len(rc.Zones) != 0 {
+			r.zones = make(map[string]bool)
+			for _, name := range rc.Zones {
+				if _, ok := zones[name]; !ok {
+					scheduleLog.Fatal("Schedule rule applies to something which isn't a zone!", "rule", rc.Name, "zone", name)
+				}
+				r.zones[name] = true
+			}
+		}
+		s.rules = append(s.rules, r)
+	}
+
+	scheduleLog.Info("Following a schedule", "rules", len(s.rules))
+	schedules = s
+}
+
+func startScheduler() {
+	if schedules == nil {
+		return
+	}
+
+	go func() {
+		for {
+			schedules.tick(time.Now())
+
+			now := time.Now()
+			time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		}
+	}()
+}
+
+// quiet names the rule which says nothing should be playing in z right now,
+// if there is one.
+func (s *scheduler) quiet(z *zone) string {
+	if s == nil {
+		return ""
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	return s.zones[z].quietRule
+}
+
+func (s *scheduler) tick(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, r := range s.rules {
+		active := r.spec.Matches(now)
+		if active != s.active[r.Name] {
+			s.active[r.Name] = active
+			scheduleLog.Info("Schedule rule changed", "rule", r.Name, "active", active)
+			h.broadcast <- ZoneMessage{"", musebot.SystemMessage{musebot.EventScheduleChanged, musebot.ScheduleChangedEvent{r.Name, r.Zones, active, r.Quiet, r.MaxVolume, r.FallbackPlaylist}}}
+		}
+	}
+
+	for z, zs := range s.zones {
+		quiet, volumeCap, fallback := "", 0, ""
+		for _, r := range s.rules {
+			if !s.active[r.Name] || !r.appliesTo(z) {
+				continue
+			}
+
+			if r.Quiet && len(quiet) == 0 {
+				quiet = r.Name
+			}
+			if r.MaxVolume > 0 && (volumeCap == 0 || r.MaxVolume < volumeCap) {
+				volumeCap = r.MaxVolume
+			}
+			if len(r.FallbackPlaylist) != 0 && len(fallback) == 0 {
+				fallback = r.FallbackPlaylist
+			}
+		}
+
+		zs.applyQuiet(z, quiet)
+		zs.applyVolumeCap(z, volumeCap)
+		zs.applyFallback(z, fallback)
+	}
+}
+
+// applyQuiet pauses whatever's playing when quiet hours start, and carries
+// on with it when they're over. Nothing queued in between (by admins, or by
+// jobs which were already going) starts until then either.
+func (zs *zoneSchedule) applyQuiet(z *zone, rule string) {
+	if len(rule) != 0 && len(zs.quietRule) == 0 {
+		if err := z.backend.HoldPlayback(true); err != nil {
+			scheduleLog.Warn("Couldn't hold playback", "zone", z.name, "error", err)
+		}
+		song, isPlaying, err := z.backend.CurrentSong()
+		if err == nil && isPlaying && song.PlaybackInfo != nil && song.PlaybackInfo.State == "play" {
+			if err := z.backend.Pause(); err != nil {
+				scheduleLog.Warn("Couldn't pause playback", "zone", z.name, "error", err)
+			} else {
+				zs.pausedForQuiet = true
+			}
+		}
+	} else if len(rule) == 0 && len(zs.quietRule) != 0 {
+		if err := z.backend.HoldPlayback(false); err != nil {
+			scheduleLog.Warn("Couldn't start what was queued during quiet hours", "zone", z.name, "error", err)
+		}
+		if zs.pausedForQuiet {
+			if err := z.backend.Play(); err != nil {
+				scheduleLog.Warn("Couldn't resume playback", "zone", z.name, "error", err)
+			}
+		}
+		zs.pausedForQuiet = false
+		// autoplay sat out quiet hours, so if there's still nothing on it
+		// can have its turn
+		z.autoplay.trigger()
+	}
+	zs.quietRule = rule
+}
+
+// applyVolumeCap turns the volume down to the cap, checking every minute in
+// case someone's turned it back up, and puts it back afterwards.
+func (zs *zoneSchedule) applyVolumeCap(z *zone, volumeCap int) {
+	if volumeCap > 0 {
+		volume, err := z.backend.Volume()
+		if err == nil && volume > volumeCap {
+			if zs.volumeBefore < 0 {
+				zs.volumeBefore = volume
+			}
+			if err := z.backend.SetVolume(volumeCap); err != nil {
+				scheduleLog.Warn("Couldn't turn the volume down", "zone", z.name, "error", err)
+			}
+		}
+	} else if zs.volumeBefore >= 0 {
+		if err := z.backend.SetVolume(zs.volumeBefore); err != nil {
+			scheduleLog.Warn("Couldn't put the volume back", "zone", z.name, "error", err)
+		}
+		zs.volumeBefore = -1
+	}
+	zs.volumeCap = volumeCap
+}
+
+func (zs *zoneSchedule) applyFallback(z *zone, ref string) {
+	if ref == zs.fallback {
+		return
+	}
+	zs.fallback = ref
+
+	if len(ref) == 0 {
+		z.autoplay.overrideFallback(nil)
+		return
+	}
+	if playlistStore == nil {
+		scheduleLog.Warn("Schedule wants to play a saved playlist, but saved playlists are turned off.", "playlist", ref)
+		return
+	}
+	slash := strings.Index(ref, "/")
+	if slash < 0 {
+		scheduleLog.Warn("Schedule wants to play a playlist which isn't an owner/name.", "playlist", ref)
+		return
+	}
+	pl, err := playlistStore.Get(ref[:slash], ref[slash+1:])
+	if err != nil {
+		scheduleLog.Warn("Couldn't load a fallback playlist", "playlist", ref, "error", err)
+		return
+	}
+	z.autoplay.overrideFallback(pl.Items)
+}
+
+// capVolume keeps volume within the schedule's cap for z, remembering what
+// was asked for so it can be put back when the cap's lifted.
+func (s *scheduler) capVolume(z *zone, volume int) int {
+	if s == nil {
+		return volume
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	zs := s.zones[z]
+	if zs.volumeCap > 0 && volume > zs.volumeCap {
+		zs.volumeBefore = volume
+		return zs.volumeCap
+	}
+	return volume
+}
+
+func (s *scheduler) status() musebot.ScheduleApiResponse {
+	out := musebot.ScheduleApiResponse{Rules: make([]musebot.ScheduleRuleStatus, 0)}
+	if s == nil {
+		return out
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	for _, r := range s.rules {
+		out.Rules = append(out.Rules, musebot.ScheduleRuleStatus{r.ScheduleRuleCfg, s.active[r.Name]})
+	}
+	return out
+}
+
+func (s *scheduler) currentVolumeCap(z *zone) int {
+	if s == nil {
+		return 0
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	return s.zones[z].volumeCap
+}
+
+// checkQuietHours refuses to queue anything while the schedule says z
+// should be quiet.
+func checkQuietHours(z *zone) error {
+	if rule := schedules.quiet(z); len(rule) != 0 {
+		return errors.New("No music right now, it's " + rule + ".")
+	}
+	return nil
+}
+
+func registerScheduleApi() {
+	handleApi("/api/schedule/", "schedule", func(ar *apiRequest) musebot.ApiResponse {
+		return schedules.status()
+	})
+
+	handleAdminApi("/api/volume/", "volume", func(ar *apiRequest) musebot.ApiResponse {
+		// each room keeps its own volume, even when it's part of a party
+		z, err := lookupZone(ar.get("zone"))
+		if err != nil {
+			return wrapApiError(err)
+		}
+
+		if len(ar.get("volume")) != 0 {
+			volume, err := ar.getInt("volume", 0)
+			if err != nil || volume > 100 {
+				return wrapApiError(errors.New("'volume' must be a percentage"))
+			}
+			if err := z.backend.SetVolume(schedules.capVolume(z, volume)); err != nil {
+				return wrapApiError(err)
+			}
+		}
+
+		volume, err := z.backend.Volume()
+		if err != nil {
+			return wrapApiError(err)
+		}
+		return musebot.VolumeApiResponse{volume, schedules.currentVolumeCap(z)}
+	})
+}
@@ -1,90 +1,119 @@
 package main
 
 import (
-	"log"
 	"musebot"
 	"musebot/auth"
 	"musebot/backend"
 	"musebot/provider"
 	"reflect"
+	"time"
 )
 
 func setupAuthenticator(config *musebot.JsonCfg) auth.Authenticator {
 	// Enumerate authenticators
-	log.Println(" - Available auth backends:")
 	authenticators := auth.Authenticators()
 	authenticatorsMap := make(map[string]auth.Authenticator)
 	for i := 0; i < len(authenticators); i++ {
 		authenticatorName := reflect.TypeOf(authenticators[i]).String()[1:]
-		log.Println("   *", authenticators[i], "("+authenticatorName+")")
+		authLog.Info("Auth backend available", "name", authenticatorName, "description", authenticators[i])
 		authenticatorsMap[authenticatorName] = authenticators[i]
 	}
 
 	// Select backend
-	log.Println(" - Selected auth backend is", config.AuthBackend)
 	authBackend, ok := authenticatorsMap[config.AuthBackend]
 	if !ok {
-		log.Fatalln("Backend not found! Double-check the config file against the list above!")
+		authLog.Fatal("Auth backend not found! Double-check the config file against the list above!", "name", config.AuthBackend)
 	}
 
-	log.Println(" - Using authenticator", authBackend)
 	authBackend.Setup(config.AuthBackendConfig[config.AuthBackend])
-	log.Println("   o OK!")
+	authLog.Info("Using auth backend", "name", config.AuthBackend)
 
 	return authBackend
 }
 
-func setupPlaybackBackend(config *musebot.JsonCfg) (backend.Backend, chan string) {
+func setupZones(config *musebot.JsonCfg) {
 
 	// Enumerate backends
-	log.Println(" - Available backends:")
 	backends := backend.Backends()
-	backendsMap := make(map[string]backend.Backend)
+	backendTypes := make(map[string]reflect.Type)
 	for i := 0; i < len(backends); i++ {
 		backendName := reflect.TypeOf(backends[i]).String()[1:]
-		log.Println("   *", backends[i], "("+backendName+")")
-		backendsMap[backendName] = backends[i]
+		backendLog.Info("Backend available", "name", backendName, "description", backends[i])
+		backendTypes[backendName] = reflect.TypeOf(backends[i]).Elem()
 	}
 
-	// Select backend
-	log.Println(" - Selected backend is", config.Backend)
-	backend, ok := backendsMap[config.Backend]
-	if !ok {
-		log.Fatalln(" x Backend not found! Double-check the config file against the list above!")
+	zoneCfgs := config.Zones
+	if len(zoneCfgs) == 0 {
+		zoneCfgs = []musebot.ZoneCfg{{"default", config.Backend, config.BackendConfig[config.Backend]}}
 	}
-	log.Println(" - Using backend", backend)
 
-	backendPipe := make(chan string)
-	backend.Setup(config.BackendConfig[config.Backend], backendPipe)
-	log.Println("   o OK!")
+	for _, zc := range zoneCfgs {
+		if _, exists := zones[zc.Name]; exists || len(zc.Name) == 0 {
+			backendLog.Fatal("Every zone needs a name of its own!", "zone", zc.Name)
+		}
+
+		// Select backend
+		backendType, ok := backendTypes[zc.Backend]
+		if !ok {
+			backendLog.Fatal("Backend not found! Double-check the config file against the list above!", "zone", zc.Name, "name", zc.Backend)
+		}
+
+		// every zone gets a backend of its own
+		z := &zone{
+			name:    zc.Name,
+			backend: reflect.New(backendType).Interface().(musebot.Backend),
+			pipe:    make(chan musebot.BackendMessage),
+		}
+		if rn, ok := z.backend.(musebot.ReconnectNotifier); ok {
+			rn.OnReconnect(func() { backendReconnects.Inc(z.name) })
+		}
+		z.backend.Setup(zc.BackendConfig, z.pipe)
+		backendLog.Info("Zone is ready", "zone", zc.Name, "backend", zc.Backend)
+
+		zones[z.name] = z
+		zoneOrder = append(zoneOrder, z.name)
+	}
 
-	return backend, backendPipe
+	defaultZone = zones[zoneOrder[0]]
+	if len(config.DefaultZone) != 0 {
+		z, ok := zones[config.DefaultZone]
+		if !ok {
+			backendLog.Fatal("DefaultZone isn't one of the zones!", "zone", config.DefaultZone)
+		}
+		defaultZone = z
+	}
+	backendLog.Info("Picked the default zone", "zone", defaultZone.name)
 }
 
 func setupSongProviders(config *musebot.JsonCfg) musebot.Providers {
 	// Enumerate providers...
-	log.Println(" - Available providers:")
 	providers := provider.Providers()
 	providersMap := make(musebot.Providers)
 	for i := 0; i < len(providers); i++ {
 		prv := providers[i]
 		providerName := reflect.TypeOf(prv).String()[1:]
-		log.Println("   *", prv, "("+providerName+")")
-		providersMap[providerName] = prv
+		providerConfig, configured := config.ProviderBackendConfig[providerName]
+
+		err := guardedProviderCall(func() error { return prv.Setup(providerConfig) })
 
-		err := prv.Setup(config.ProviderBackendConfig[providerName])
+		if err != nil && !configured {
+			// there's nothing to retry with
+			providerLog.Info("Provider isn't configured, and couldn't be enabled without it, so it has been disabled", "provider", providerName, "description", prv, "error", err)
+			continue
+		}
+		providersMap[providerName] = prv
 
 		if err != nil {
-			log.Println("     ! There was an error enabling the provider:", err)
-			log.Println("       The provider has been disabled.")
-			delete(providersMap, providerName)
+			providerLog.Warn("There was an error enabling the provider; it will be retried in the background", "provider", providerName, "error", err)
+			providerHealth.record(providerName, err, time.Now().Add(initialProviderBackoff))
 		} else {
-			log.Println("     o OK!")
+			providerLog.Info("Provider enabled", "provider", providerName, "description", prv)
+			providerHealth.record(providerName, nil, time.Time{})
 		}
 	}
 
 	if len(providersMap) == 0 {
-		log.Fatalln("   x No providers were available!")
+		providerLog.Fatal("No providers were configured!")
 	}
 
 	return providersMap
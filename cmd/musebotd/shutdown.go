@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"musebot"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var shutdownRequests = make(chan string, 1)
+
+var shuttingDown int32 // atomic; 1 once we've started
+
+// closed to hang up on event streams, which would otherwise hold up the HTTP
+// servers shutting down until the deadline
+var stopStreaming = make(chan bool)
+
+var errShuttingDown = errors.New("MuseBot is shutting down. Try again once it's back!")
+
+// pendingJob is a fetch which didn't finish before we shut down, kept so it
+// can be started again next time.
+type pendingJob struct {
+	User string
+	Zone string
+	Item musebot.PlaylistItem
+}
+
+func requestShutdown(reason string) {
+	select {
+	case shutdownRequests <- reason:
+	default: // someone else got there first
+	}
+}
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) != 0
+}
+
+// waitForShutdown blocks until we're told to stop, by a signal or over the
+// API, and then shuts everything down as tidily as it can.
+func waitForShutdown(cfg *musebot.JsonCfg) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	var reason string
+	select {
+	case sig := <-signals:
+		reason = "Received " + sig.String()
+	case reason = <-shutdownRequests:
+	}
+	signal.Stop(signals)
+
+	shutdown(cfg, reason)
+}
+
+func shutdown(cfg *musebot.JsonCfg, reason string) {
+	atomic.StoreInt32(&shuttingDown, 1)
+	mainLog.Info("Shutting down", "reason", reason)
+
+	timeout := time.Duration(cfg.ShutdownTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+
+	h.broadcast <- ZoneMessage{"", musebot.SystemMessage{musebot.EventShutdown, musebot.ShutdownEvent{reason}}}
+
+	// stop taking requests, but let the ones we've got finish
+	close(stopStreaming)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	for _, srv := range httpServers {
+		if err := srv.Shutdown(ctx); err != nil {
+			httpLog.Warn("Couldn't shut the server down cleanly", "addr", srv.Addr, "error", err)
+		}
+	}
+	cancel()
+
+	// websockets are still open, so people can watch their jobs finish
+	unfinished := activeJobs.waitUntilIdle(time.After(deadline.Sub(time.Now())))
+	persistPendingJobs(cfg.PendingJobsFile, unfinished)
+
+	done := make(chan bool)
+	h.closeAll <- done
+	<-done
+
+	for _, name := range zoneOrder {
+		if err := zones[name].backend.Close(); err != nil {
+			backendLog.Warn("Couldn't close the backend", "zone", name, "error", err)
+		}
+	}
+
+	mainLog.Info("Bye!")
+}
+
+func persistPendingJobs(file string, unfinished []jobEntry) {
+	pending := make([]pendingJob, 0, len(unfinished))
+	for _, j := range unfinished {
+		log := jobsLog.With("job", j.status.JobId, "user", j.user, "zone", j.status.Zone)
+		if len(j.status.Playlist) != 0 || len(file) == 0 {
+			log.Warn("Abandoning a job which didn't finish in time", "playlist", j.status.Playlist, "title", j.status.Song.Title)
+			continue
+		}
+		pending = append(pending, pendingJob{j.user, j.status.Zone, musebot.PlaylistItemFromSongInfo(j.status.Song)})
+		log.Info("Keeping a job which didn't finish in time for next time", "title", j.status.Song.Title)
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	b, err := json.Marshal(pending)
+	if err == nil {
+		err = ioutil.WriteFile(file, b, 0600)
+	}
+	if err != nil {
+		jobsLog.Error("Couldn't keep the jobs which didn't finish", "file", file, "error", err)
+	}
+}
+
+// resumePendingJobs starts again whatever didn't finish last time we shut
+// down. They were let past the queue policy once already.
+func resumePendingJobs(cfg *musebot.JsonCfg) {
+	if len(cfg.PendingJobsFile) == 0 {
+		return
+	}
+	b, err := ioutil.ReadFile(cfg.PendingJobsFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	os.Remove(cfg.PendingJobsFile) // only ever try once
+
+	var pending []pendingJob
+	if err == nil {
+		err = json.Unmarshal(b, &pending)
+	}
+	if err != nil {
+		jobsLog.Error("Couldn't read the jobs left over from last time", "file", cfg.PendingJobsFile, "error", err)
+		return
+	}
+
+	for _, p := range pending {
+		log := jobsLog.With("request", newRequestId(), "user", p.User, "zone", p.Zone)
+		z, ok := zones[p.Zone]
+		if !ok {
+			log.Warn("Can't resume a job for a zone which has gone away", "title", p.Item.Title)
+			continue
+		}
+		si, err := songFromProvider(p.Item.ProviderName, p.Item.ProviderId)
+		if err != nil {
+			log.Warn("Can't resume a job", "title", p.Item.Title, "error", err)
+			continue
+		}
+		log.Info("Resuming a job left over from last time", "title", si.Title)
+		if resp, failed := fetchAndQueue(z, &si, admitUnpoliced(z, si, p.User), log).(musebot.ErrorApiResponse); failed {
+			log.Warn("Can't resume a job", "title", si.Title, "error", resp.Error)
+		}
+	}
+}
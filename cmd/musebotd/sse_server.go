@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"musebot"
+	"net/http"
+	"time"
+)
+
+// writeSseEvent writes an event in text/event-stream format. Its id is the
+// sequence number, so that browsers send it back as Last-Event-ID when they
+// reconnect. Ephemeral events don't have one, and mustn't reset it.
+func writeSseEvent(w http.ResponseWriter, ev *musebot.Event) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return nil // not worth giving up on the client for
+	}
+	if ev.Sequence != 0 {
+		if _, err = fmt.Fprintf(w, "id: %d\n", ev.Sequence); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, b)
+	return err
+}
+
+// sseHandler follows the hub as a stream of Server-Sent Events, for clients
+// which can't get a websocket through.
+func sseHandler(w http.ResponseWriter, r *http.Request) {
+	session := getSession(r)
+	if !enforceLoggedIn(session, w) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeApiResponse(w, wrapApiError(errors.New("Streaming isn't supported here.")))
+		return
+	}
+
+	since := parseSince(r.Header.Get("Last-Event-ID"))
+	if since < 0 {
+		since = parseSince(r.FormValue("since"))
+	}
+
+	following, err := parseZoneList(r.FormValue("zones"))
+	if err != nil {
+		writeApiResponse(w, wrapApiError(err))
+		return
+	}
+
+	hungUp := make(chan bool)
+	c := &connection{
+		send:    make(chan *musebot.Event, h.historySize+256),
+		hangUp:  func() { safeCloseBool(hungUp) },
+		user:    session.Values["username"].(string),
+		session: session,
+		since:   since,
+		zones:   following,
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // stop nginx holding onto events
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	h.register <- c
+	defer func() { h.unregister <- c }()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case ev, ok := <-c.send:
+			if !ok {
+				return
+			}
+			if err := writeSseEvent(w, ev); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			// comments keep proxies from deciding the connection is dead
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-hungUp:
+			return
+		case <-stopStreaming:
+			// pass on whatever's left, like the SHUTDOWN event
+			for {
+				select {
+				case ev, ok := <-c.send:
+					if ok && writeSseEvent(w, ev) == nil {
+						continue
+					}
+				default:
+				}
+				flusher.Flush()
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func safeCloseBool(c chan bool) {
+	defer func() { recover() }()
+	close(c)
+}
+
+func registerSseHandler() {
+	http.HandleFunc("/api/events/", sseHandler)
+}
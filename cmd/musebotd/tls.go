@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"golang.org/x/crypto/acme/autocert"
+	"musebot"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var trustedProxies []*net.IPNet
+
+func setupTrustedProxies(cfg musebot.TlsCfg) {
+	for _, cidr := range cfg.TrustedProxies {
+		// a lone address is a network of one
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			httpLog.Fatal("TrustedProxies has something in it which isn't a CIDR", "proxy", cidr, "error", err)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+}
+
+func fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSecure says whether r came in over HTTPS, either to us or to a proxy we
+// trust to tell us so.
+func isSecure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") && fromTrustedProxy(r)
+}
+
+// redirectToHttps sends anything which didn't come in over HTTPS to the same
+// place on sslListenAddr's port. The health checks and metrics are left
+// alone, so that whatever's calling them doesn't have to follow redirects.
+func redirectToHttps(sslListenAddr string, next http.Handler) http.Handler {
+	_, port, _ := net.SplitHostPort(sslListenAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isSecure(r) || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if len(port) != 0 && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// setupTlsConfig is what the HTTPS server should use, along with the
+// certificate and key files to load, if any. With ACME, certificates come
+// from Let's Encrypt instead, and acmeManager is set so that the HTTP server
+// can answer its challenges.
+func setupTlsConfig(cfg musebot.TlsCfg) (tlsConfig *tls.Config, certFile string, keyFile string, acmeManager *autocert.Manager) {
+	if len(cfg.AcmeDomains) != 0 {
+		if len(cfg.AcmeCacheDir) == 0 {
+			httpLog.Fatal("AcmeCacheDir must be set, or there'll be a new certificate every restart.")
+		}
+		acmeManager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cfg.AcmeCacheDir),
+			HostPolicy: autocert.HostWhitelist(cfg.AcmeDomains...),
+			Email:      cfg.AcmeEmail,
+		}
+		httpLog.Info("Getting certificates from Let's Encrypt", "domains", strings.Join(cfg.AcmeDomains, ","))
+		return acmeManager.TLSConfig(), "", "", acmeManager
+	}
+
+	certFile, keyFile = cfg.CertFile, cfg.KeyFile
+	if len(certFile) == 0 {
+		certFile = "ssl.pub.pem"
+	}
+	if len(keyFile) == 0 {
+		keyFile = "ssl.priv.pem"
+	}
+	return nil, certFile, keyFile, nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// the web UI; everything it does goes through /api/ and /ws, like any other
+// client
+//
+//go:embed ui
+var uiFiles embed.FS
+
+func registerUi() {
+	sub, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		httpLog.Fatal("Couldn't find the web UI", "error", err)
+	}
+	http.Handle("/", http.FileServer(http.FS(sub)))
+}
@@ -0,0 +1,485 @@
+// MuseBot's web UI. Everything it knows comes from the HTTP API and the
+// events sent down /ws; see events.go for what those look like.
+(function () {
+	"use strict";
+
+	const AUTOPLAY_CULPRIT = "<<AUTOPLAY>>";
+
+	const state = {
+		user: localStorage.getItem("musebot.user") || "",
+		zone: localStorage.getItem("musebot.zone") || "",
+		sequence: -1, // the last event we've seen, to pick up from when reconnecting
+		ws: null,
+		retryDelay: 1000,
+
+		current: null, // SongInfo, or null when nothing's playing
+		playState: "stop",
+		position: 0, // seconds, as of positionAt
+		positionAt: 0,
+		queue: [],
+		jobs: {}, // JobId -> {title, progress}
+	};
+
+	function $(id) {
+		return document.getElementById(id);
+	}
+
+	function el(tag, text, className) {
+		const e = document.createElement(tag);
+		if (text !== undefined) {
+			e.textContent = text;
+		}
+		if (className) {
+			e.className = className;
+		}
+		return e;
+	}
+
+	class NotLoggedIn extends Error {}
+
+	// api calls /api/<method>/ with args, in the current zone, and resolves
+	// to its response. Errors the API returns are thrown.
+	async function api(method, args, post) {
+		const params = new URLSearchParams(args || {});
+		if (state.zone && !params.has("zone")) {
+			params.set("zone", state.zone);
+		}
+		let resp;
+		if (post) {
+			resp = await fetch("/api/" + method + "/", {method: "POST", body: params, credentials: "same-origin"});
+		} else {
+			resp = await fetch("/api/" + method + "/?" + params, {credentials: "same-origin"});
+		}
+		if (resp.status === 403) {
+			showLogin();
+			throw new NotLoggedIn("You must be logged in to do that!");
+		}
+		const body = await resp.json();
+		if (body && body.Error) {
+			throw new Error(body.Error);
+		}
+		return body;
+	}
+
+	function showBanner(text) {
+		$("banner").textContent = text;
+		$("banner").hidden = !text;
+	}
+
+	function formatTime(seconds) {
+		seconds = Math.max(0, Math.floor(seconds || 0));
+		const s = seconds % 60;
+		return Math.floor(seconds / 60) + ":" + (s < 10 ? "0" : "") + s;
+	}
+
+	function describe(si) {
+		return si.Artist ? si.Artist + " - " + si.Title : si.Title;
+	}
+
+	function culprit(si) {
+		const who = si.QueueInfo && si.QueueInfo.Culprit;
+		if (!who) {
+			return "";
+		}
+		return who === AUTOPLAY_CULPRIT ? "picked by autoplay" : "queued by " + who;
+	}
+
+	function votesAgainst(si) {
+		return (si.QueueInfo && si.QueueInfo.VotedAgainst) || [];
+	}
+
+	// logging in and out
+
+	function showLogin() {
+		disconnect();
+		$("app").hidden = true;
+		$("logout").hidden = true;
+		$("zone").hidden = true;
+		$("whoami").textContent = "";
+		$("login").hidden = false;
+	}
+
+	async function showApp() {
+		$("login").hidden = true;
+		$("app").hidden = false;
+		$("logout").hidden = false;
+		$("whoami").textContent = state.user;
+		await loadZones();
+		connect();
+	}
+
+	$("login").addEventListener("submit", async function (e) {
+		e.preventDefault();
+		$("login-error").textContent = "";
+		const form = new FormData($("login"));
+		try {
+			const resp = await api("login", {username: form.get("username"), password: form.get("password")}, true);
+			state.user = resp.Username;
+			localStorage.setItem("musebot.user", state.user);
+			$("login").reset();
+			await showApp();
+		} catch (err) {
+			$("login-error").textContent = err.message;
+		}
+	});
+
+	$("logout").addEventListener("click", async function () {
+		try {
+			await api("logout");
+		} catch (err) {
+			// we're logging out anyway
+		}
+		localStorage.removeItem("musebot.user");
+		state.user = "";
+		showLogin();
+	});
+
+	// zones
+
+	async function loadZones() {
+		const resp = await api("zones", {zone: ""});
+		const names = resp.Zones.map(function (z) { return z.Name; });
+		if (names.indexOf(state.zone) < 0) {
+			state.zone = resp.Default;
+		}
+
+		const select = $("zone");
+		select.textContent = "";
+		names.forEach(function (name) {
+			const option = el("option", name);
+			option.value = name;
+			option.selected = name === state.zone;
+			select.appendChild(option);
+		});
+		select.hidden = names.length < 2;
+	}
+
+	$("zone").addEventListener("change", function () {
+		state.zone = $("zone").value;
+		localStorage.setItem("musebot.zone", state.zone);
+		state.sequence = -1; // a snapshot of the new zone, please
+		state.jobs = {};
+		connect();
+	});
+
+	// the websocket
+
+	function disconnect() {
+		if (state.ws) {
+			const ws = state.ws;
+			state.ws = null;
+			ws.close();
+		}
+	}
+
+	function connect() {
+		disconnect();
+
+		let url = (location.protocol === "https:" ? "wss://" : "ws://") + location.host + "/ws?zones=" + encodeURIComponent(state.zone);
+		if (state.sequence >= 0) {
+			url += "&since=" + state.sequence;
+		}
+		const ws = new WebSocket(url);
+		state.ws = ws;
+
+		ws.onopen = function () {
+			state.retryDelay = 1000;
+		};
+		ws.onmessage = function (msg) {
+			const ev = JSON.parse(msg.data);
+			if (ev.Sequence > state.sequence) {
+				state.sequence = ev.Sequence;
+			}
+			handleEvent(ev);
+		};
+		ws.onclose = function () {
+			if (state.ws !== ws) {
+				return; // we meant to do that
+			}
+			state.ws = null;
+			setTimeout(connect, state.retryDelay);
+			state.retryDelay = Math.min(state.retryDelay * 2, 30000);
+		};
+	}
+
+	function setCurrent(song) {
+		state.current = song || null;
+		const info = song && song.PlaybackInfo;
+		state.position = info ? info.Position : 0;
+		state.playState = info ? info.State : (song ? "play" : "stop");
+		state.positionAt = Date.now();
+	}
+
+	function handleEvent(ev) {
+		if (ev.Zone && ev.Zone !== state.zone) {
+			return;
+		}
+		const p = ev.Payload;
+
+		switch (ev.Type) {
+		case "NOT_LOGGED_IN":
+			showLogin();
+			break;
+		case "SNAPSHOT":
+			showBanner("");
+			setCurrent(p.Playing ? p.CurrentSong : null);
+			state.queue = p.Queue || [];
+			state.jobs = {};
+			(p.Jobs || []).forEach(function (j) {
+				state.jobs[j.JobId] = {title: j.Playlist || describe(j.Song), progress: j.Progress || {}};
+			});
+			render();
+			break;
+		case "SONG_CHANGED":
+			setCurrent(p.Song);
+			renderNowPlaying();
+			refreshQueue();
+			break;
+		case "POSITION":
+			if (state.current && p.SongId === state.current.Id) {
+				state.position = p.Position;
+				state.positionAt = Date.now();
+				state.playState = p.State;
+			}
+			break;
+		case "SEEKED":
+			state.position = p.To;
+			state.positionAt = Date.now();
+			break;
+		case "PLAYBACK_STATE_CHANGE":
+			state.position = currentPosition();
+			state.positionAt = Date.now();
+			state.playState = p.State;
+			if (p.State === "stop") {
+				state.current = null;
+			}
+			renderNowPlaying();
+			break;
+		case "PLAYLIST_ADD":
+		case "PLAYLIST_REMOVE":
+		case "RELOAD_PLAYLIST":
+			refreshQueue();
+			break;
+		case "JOB_DATA":
+			updateJob(p.JobId, p.Data);
+			break;
+		case "SHUTDOWN":
+			showBanner("MuseBot is shutting down (" + p.Reason + "). We'll reconnect once it's back.");
+			break;
+		}
+	}
+
+	let queueRefresh = null;
+
+	// refreshQueue fetches the queue again, once things have settled down;
+	// events tend to come in bunches.
+	function refreshQueue() {
+		clearTimeout(queueRefresh);
+		queueRefresh = setTimeout(async function () {
+			try {
+				state.queue = (await api("playback_queue")).Queue || [];
+				renderQueue();
+			} catch (err) {
+				// the next event will have another go
+			}
+		}, 200);
+	}
+
+	// now playing
+
+	function currentPosition() {
+		if (state.playState !== "play") {
+			return state.position;
+		}
+		return state.position + (Date.now() - state.positionAt) / 1000;
+	}
+
+	function renderNowPlaying() {
+		const si = state.current;
+		$("np-title").textContent = si ? si.Title : "Nothing's playing";
+		$("np-artist").textContent = si ? si.Artist : "";
+		$("np-album").textContent = si ? si.Album : "";
+		$("cover").hidden = !(si && si.CoverArtUrl);
+		if (si && si.CoverArtUrl) {
+			$("cover").src = si.CoverArtUrl;
+		}
+		$("np-vote").hidden = !si || votesAgainst(si).indexOf(state.user) >= 0;
+		renderPosition();
+	}
+
+	function renderPosition() {
+		const si = state.current;
+		if (!si) {
+			$("np-progress").value = 0;
+			$("np-time").textContent = "";
+			return;
+		}
+		const position = si.Length > 0 ? Math.min(currentPosition(), si.Length) : currentPosition();
+		$("np-progress").value = si.Length > 0 ? position / si.Length : 0;
+		$("np-time").textContent = formatTime(position) + (si.Length > 0 ? " / " + formatTime(si.Length) : "") + (state.playState === "pause" ? " (paused)" : "");
+	}
+
+	setInterval(renderPosition, 500);
+
+	$("np-vote").addEventListener("click", function () {
+		if (state.current) {
+			vote(state.current);
+		}
+	});
+
+	// the queue
+
+	function renderQueue() {
+		const list = $("queue");
+		list.textContent = "";
+		const upNext = state.queue.filter(function (si) {
+			return !state.current || si.Id !== state.current.Id;
+		});
+		upNext.forEach(function (si) {
+			const li = el("li");
+			li.appendChild(el("span", describe(si)));
+			const votes = votesAgainst(si);
+			let meta = culprit(si);
+			if (votes.length) {
+				meta += (meta ? ", " : "") + votes.length + (votes.length === 1 ? " vote" : " votes") + " to skip";
+			}
+			if (meta) {
+				li.appendChild(el("span", " " + meta, "meta"));
+			}
+			if (votes.indexOf(state.user) < 0) {
+				const button = el("button", "Vote to skip");
+				button.addEventListener("click", function () { vote(si); });
+				li.appendChild(button);
+			}
+			list.appendChild(li);
+		});
+		$("queue-empty").hidden = upNext.length !== 0;
+	}
+
+	async function vote(si) {
+		try {
+			const resp = await api("vote", {song_id: si.Id});
+			si.QueueInfo = si.QueueInfo || {};
+			si.QueueInfo.VotedAgainst = resp.VotedAgainst;
+			if (resp.Removed) {
+				refreshQueue();
+			}
+			render();
+		} catch (err) {
+			showBanner(err.message);
+		}
+	}
+
+	// jobs
+
+	function updateJob(jobId, m) {
+		let job = state.jobs[jobId];
+		if (!job) {
+			job = state.jobs[jobId] = {title: "Song " + jobId, progress: {}};
+		}
+		if (m.Type === "done") {
+			delete state.jobs[jobId];
+		} else if (m.Type === "error") {
+			delete state.jobs[jobId];
+			showBanner("Couldn't fetch " + job.title + ": " + m.Content);
+		} else {
+			job.progress[m.Type] = m.Content;
+		}
+		renderJobs();
+	}
+
+	function renderJobs() {
+		const list = $("jobs");
+		list.textContent = "";
+		const ids = Object.keys(state.jobs);
+		ids.forEach(function (id) {
+			const job = state.jobs[id];
+			const p = job.progress;
+			const li = el("li", job.title);
+			const bar = el("progress");
+			if (p.stages > 1 && p.current_stage) {
+				// whole playlists go a song at a time
+				bar.max = p.stages;
+				bar.value = p.current_stage;
+			} else if (p.length > 0 && p.downloaded !== undefined) {
+				bar.max = p.length;
+				bar.value = p.downloaded;
+			}
+			li.appendChild(bar);
+			if (p.current_stage_description) {
+				li.appendChild(el("span", " " + p.current_stage_description, "meta"));
+			}
+			list.appendChild(li);
+		});
+		$("jobs-section").hidden = ids.length === 0;
+	}
+
+	// searching
+
+	$("search").addEventListener("submit", async function (e) {
+		e.preventDefault();
+		$("search-error").textContent = "";
+		const q = new FormData($("search")).get("q");
+		const list = $("results");
+		list.textContent = "";
+		try {
+			const resp = await api("search", {q: q, limit: 25});
+			if (!resp.Results.length) {
+				$("search-error").textContent = "Nothing found.";
+			}
+			resp.Results.forEach(function (si) {
+				const li = el("li");
+				li.appendChild(el("span", describe(si)));
+				let meta = si.Album || "";
+				if (si.Length > 0) {
+					meta += (meta ? ", " : "") + formatTime(si.Length);
+				}
+				if (si.BlockInfo) {
+					meta += (meta ? ", " : "") + "flagged: " + si.BlockInfo.Reason;
+				}
+				if (meta) {
+					li.appendChild(el("span", " " + meta, "meta"));
+				}
+				const button = el("button", "Queue");
+				button.addEventListener("click", function () { enqueue(si, button); });
+				li.appendChild(button);
+				list.appendChild(li);
+			});
+		} catch (err) {
+			$("search-error").textContent = err.message;
+		}
+	});
+
+	async function enqueue(si, button) {
+		button.disabled = true;
+		try {
+			const resp = await api("add_to_queue", {provider: si.ProviderName, provider_id: si.ProviderId});
+			if (resp.JobId !== undefined) {
+				// it'll be on the queue once it's downloaded
+				if (!state.jobs[resp.JobId]) {
+					state.jobs[resp.JobId] = {title: describe(si), progress: {}};
+				} else {
+					state.jobs[resp.JobId].title = describe(si);
+				}
+				renderJobs();
+			}
+			button.textContent = "Queued";
+		} catch (err) {
+			button.disabled = false;
+			$("search-error").textContent = err.message;
+		}
+	}
+
+	function render() {
+		renderNowPlaying();
+		renderQueue();
+		renderJobs();
+	}
+
+	// off we go: if ping works, we're already logged in
+	api("ping", {zone: ""}).then(showApp, function (err) {
+		if (!(err instanceof NotLoggedIn)) {
+			showBanner(err.message);
+		}
+	});
+})();
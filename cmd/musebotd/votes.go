@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"musebot"
+	"strconv"
+	"sync"
+)
+
+type voteRegistry struct {
+	sync.Mutex
+	votes map[string][]string // zone and backend song Id -> who voted against it
+}
+
+var votes = voteRegistry{votes: make(map[string][]string)}
+
+// song Ids are only unique within a backend
+func voteKey(z *zone, songId string) string {
+	return z.name + "\x00" + songId
+}
+
+// against records user's vote against the song with the given Id, returning
+// everyone who has now voted against it.
+func (vr *voteRegistry) against(z *zone, songId string, user string) []string {
+	vr.Lock()
+	defer vr.Unlock()
+
+	key := voteKey(z, songId)
+	for _, u := range vr.votes[key] {
+		if u == user {
+			return append([]string{}, vr.votes[key]...)
+		}
+	}
+	vr.votes[key] = append(vr.votes[key], user)
+	return append([]string{}, vr.votes[key]...)
+}
+
+func (vr *voteRegistry) forSong(z *zone, songId string) []string {
+	vr.Lock()
+	defer vr.Unlock()
+
+	return append([]string{}, vr.votes[voteKey(z, songId)]...)
+}
+
+// forget throws away votes for songs which aren't around any more.
+func (vr *voteRegistry) forget(z *zone, songId string) {
+	vr.Lock()
+	defer vr.Unlock()
+
+	delete(vr.votes, voteKey(z, songId))
+}
+
+// forgetRemovedSongs is a backend observer which clears out votes once songs
+// leave the queue.
+func forgetRemovedSongs(z *zone, m musebot.BackendMessage) {
+	if m.Type == musebot.EventPlaylistRemove {
+		votes.forget(z, strconv.Itoa(m.Content.(musebot.PlaylistRemoveEvent).Id))
+	}
+}
+
+// annotateVotes fills in who has voted against si, if it's been queued.
+func annotateVotes(z *zone, si *musebot.SongInfo) {
+	if si.QueueInfo == nil {
+		si.QueueInfo = &musebot.QueuedSongInfo{}
+	}
+	si.QueueInfo.VotedAgainst = votes.forSong(z, si.Id)
+}
+
+// voteAgainst has user vote against the queued song with the given Id. Once
+// enough people have, or the person who queued it changes their mind, it's
+// skipped if it's playing or taken off the queue if not.
+func voteAgainst(z *zone, songId string, user string, threshold int) (musebot.VotedApiResponse, error) {
+	current, isPlaying, err := z.backend.CurrentSong()
+	if err != nil {
+		return musebot.VotedApiResponse{}, err
+	}
+
+	var song *musebot.SongInfo
+	if isPlaying && current.Id == songId {
+		song = &current
+	} else {
+		queue, err := z.backend.PlaybackQueue()
+		if err != nil {
+			return musebot.VotedApiResponse{}, err
+		}
+		for i := range queue {
+			if queue[i].Id == songId {
+				song = &queue[i]
+				break
+			}
+		}
+	}
+	if song == nil {
+		return musebot.VotedApiResponse{}, errors.New("That song isn't in the queue.")
+	}
+
+	against := votes.against(z, songId, user)
+	resp := musebot.VotedApiResponse{SongId: songId, VotedAgainst: against, Threshold: threshold}
+
+	// people can always change their minds, and nobody chose autoplay's picks
+	vetoed := song.QueueInfo != nil && (song.QueueInfo.Culprit == user || song.QueueInfo.Culprit == musebot.AutoplayCulprit)
+	if len(against) < threshold && !vetoed {
+		return resp, nil
+	}
+
+	if isPlaying && current.Id == songId {
+		err = z.backend.Next()
+	} else {
+		err = z.backend.Remove(*song)
+	}
+	if err != nil {
+		return resp, err
+	}
+	resp.Removed = true
+
+	return resp, nil
+}
@@ -2,13 +2,32 @@ package main
 
 import (
 	"code.google.com/p/go.net/websocket"
-	"log"
+	"code.google.com/p/gorilla/sessions"
+	"encoding/json"
+	"errors"
+	"musebot"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type UserMessage struct {
 	user    string
-	message string
+	message musebot.SystemMessage
+}
+
+// ZoneMessage is for everyone following zone, or everyone at all if zone is
+// empty.
+type ZoneMessage struct {
+	zone    string
+	message musebot.SystemMessage
+}
+
+type directMessage struct {
+	conn    *connection
+	message musebot.SystemMessage
 }
 
 type hub struct {
@@ -16,76 +35,449 @@ type hub struct {
 	connections map[*connection]bool
 
 	// Inbound messages from the connections.
-	broadcast chan string
+	broadcast chan ZoneMessage
 
 	broadcastUser chan UserMessage
 
+	// Messages for a single connection, outside the sequence.
+	direct chan directMessage
+
 	// Register requests from the connections.
 	register chan *connection
 
+	// Connections changing which zones they follow.
+	subscribe chan subscription
+
+	// Asks for every connection to be hung up; answered once they have.
+	closeAll chan chan bool
+
+	// Snapshots, once they've been built.
+	snapshots chan snapshotResult
+
 	// Unregister requests from connections.
 	unregister chan *connection
+
+	// Sequence number of the last event sent out.
+	sequence uint64
+
+	// The most recent events, so reconnecting clients can catch up.
+	history     []bufferedEvent
+	historySize int
+}
+
+type bufferedEvent struct {
+	user string // empty if it went to everyone
+	ev   *musebot.Event
+}
+
+type subscription struct {
+	conn  *connection
+	zones map[string]bool
+}
+
+type snapshotResult struct {
+	conn      *connection
+	snapshots []*musebot.Event
 }
 
 var h = hub{
-	broadcast:     make(chan string),
+	broadcast:     make(chan ZoneMessage),
 	broadcastUser: make(chan UserMessage),
+	direct:        make(chan directMessage),
 	register:      make(chan *connection),
+	subscribe:     make(chan subscription),
+	closeAll:      make(chan chan bool),
+	snapshots:     make(chan snapshotResult),
 	unregister:    make(chan *connection),
 	connections:   make(map[*connection]bool),
 }
 
-func safeClose(c chan string) {
+func safeClose(c chan *musebot.Event) {
 	defer func() { recover() }()
 	close(c)
 }
 
+func (h *hub) newEvent(zone string, m musebot.SystemMessage) *musebot.Event {
+	h.sequence++
+	return &musebot.Event{
+		Version:   musebot.EventProtocolVersion,
+		Type:      m.Type,
+		Zone:      zone,
+		Sequence:  h.sequence,
+		Timestamp: time.Now(),
+		Payload:   m.Content,
+	}
+}
+
+// newEphemeralEvent is for events outside the sequence, which nobody will
+// ever need to catch up on.
+func newEphemeralEvent(zone string, m musebot.SystemMessage) *musebot.Event {
+	return &musebot.Event{
+		Version:   musebot.EventProtocolVersion,
+		Type:      m.Type,
+		Zone:      zone,
+		Timestamp: time.Now(),
+		Payload:   m.Content,
+	}
+}
+
+func (h *hub) remember(user string, ev *musebot.Event) {
+	if len(h.history) >= h.historySize {
+		h.history = h.history[1:]
+	}
+	h.history = append(h.history, bufferedEvent{user, ev})
+}
+
+// canResumeFrom says whether we still have every event after since.
+func (h *hub) canResumeFrom(since uint64) bool {
+	if since > h.sequence {
+		// from before a restart
+		return false
+	}
+	if len(h.history) == 0 {
+		return since == h.sequence
+	}
+	return since+1 >= h.history[0].ev.Sequence
+}
+
+func buildSnapshot(user string, z *zone) musebot.SnapshotEvent {
+	snapshot := musebot.SnapshotEvent{Queue: make([]musebot.SongInfo, 0), Jobs: activeJobs.forUser(user, z)}
+
+	currentSong, isPlaying, err := z.backend.CurrentSong()
+	if err == nil && isPlaying {
+		annotateVotes(z, &currentSong)
+		snapshot.Playing = true
+		snapshot.CurrentSong = &currentSong
+	}
+
+	queue, err := z.backend.PlaybackQueue()
+	if err == nil {
+		for i := range queue {
+			annotateVotes(z, &queue[i])
+		}
+		snapshot.Queue = queue
+	}
+
+	return snapshot
+}
+
+// startSnapshots has snapshots of the named zones built for c. Backends can
+// be slow to answer, so that's done away from the hub, and until they're
+// ready anything else for c is held back; it mustn't see events which come
+// after the snapshot before the snapshot itself.
+func (h *hub) startSnapshots(c *connection, names []string) {
+	if len(names) == 0 {
+		return
+	}
+	c.snapshotting++
+
+	go func() {
+		result := snapshotResult{c, make([]*musebot.Event, 0, len(names))}
+		for _, name := range names {
+			result.snapshots = append(result.snapshots, &musebot.Event{
+				Version:   musebot.EventProtocolVersion,
+				Type:      musebot.EventSnapshot,
+				Zone:      name,
+				Timestamp: time.Now(),
+				Payload:   buildSnapshot(c.user, zones[name]),
+			})
+		}
+		h.snapshots <- result
+	}()
+}
+
+// finishSnapshots sends c the snapshots it was waiting for. Whatever happened
+// in those zones while they were being built is already in them, so it's
+// dropped from what was held back rather than being sent twice.
+func (h *hub) finishSnapshots(r snapshotResult) {
+	c := r.conn
+	c.snapshotting--
+
+	covered := make(map[string]bool)
+	for _, ev := range r.snapshots {
+		ev.Sequence = h.sequence
+		covered[ev.Zone] = true
+	}
+	kept := c.held[:0]
+	for _, ev := range c.held {
+		if ev.Sequence == 0 || !covered[ev.Zone] {
+			kept = append(kept, ev)
+		}
+	}
+	c.held = kept
+
+	for _, ev := range r.snapshots {
+		if !h.connections[c] {
+			return
+		}
+		h.send(c, ev)
+	}
+	if c.snapshotting != 0 {
+		return
+	}
+
+	held := c.held
+	c.held = nil
+	for _, ev := range held {
+		if !h.connections[c] {
+			return
+		}
+		h.send(c, ev)
+	}
+}
+
+// catchUp gets a newly registered connection up to date, either by replaying
+// what it missed or, if that's not possible, with a snapshot.
+func (h *hub) catchUp(c *connection) {
+	if c.since >= 0 && h.canResumeFrom(uint64(c.since)) {
+		for _, be := range h.history {
+			if be.ev.Sequence > uint64(c.since) && (be.user == "" || be.user == c.user) && c.follows(be.ev.Zone) {
+				h.send(c, be.ev)
+			}
+		}
+		return
+	}
+
+	names := make([]string, 0)
+	for _, name := range zoneOrder {
+		if c.follows(name) {
+			names = append(names, name)
+		}
+	}
+	h.startSnapshots(c, names)
+}
+
+// deliver sends ev to c, unless it's waiting for a snapshot, in which case
+// ev waits too.
+func (h *hub) deliver(c *connection, ev *musebot.Event) {
+	if c.snapshotting == 0 {
+		h.send(c, ev)
+		return
+	}
+	if len(c.held) >= cap(c.send) {
+		wsLog.Warn("Client's snapshot is taking too long; disconnecting it", "user", c.user)
+		hubDrops.Inc()
+		delete(h.connections, c)
+		safeClose(c.send)
+		go c.hangUp()
+		return
+	}
+	c.held = append(c.held, ev)
+}
+
+func (h *hub) send(c *connection, ev *musebot.Event) {
+	select {
+	case c.send <- ev:
+	default:
+		// they can reconnect and catch up once they're less busy
+		wsLog.Warn("Client couldn't keep up; disconnecting it", "user", c.user)
+		hubDrops.Inc()
+		delete(h.connections, c)
+		safeClose(c.send)
+		go c.hangUp()
+	}
+}
+
 func (h *hub) run() {
 	for {
 		select {
 		case c := <-h.register:
 			h.connections[c] = true
+			h.catchUp(c)
 		case c := <-h.unregister:
 			delete(h.connections, c)
 			//close(c.send)
 			safeClose(c.send)
-		case m := <-h.broadcast:
+		case s := <-h.subscribe:
+			if !h.connections[s.conn] {
+				continue
+			}
+			// anything they weren't following before, they need to catch up on
+			was := s.conn.zones
+			s.conn.zones = s.zones
+			names := make([]string, 0)
+			for _, name := range zoneOrder {
+				if s.conn.follows(name) && !(was == nil || was[name]) {
+					names = append(names, name)
+				}
+			}
+			h.startSnapshots(s.conn, names)
+		case r := <-h.snapshots:
+			h.finishSnapshots(r)
+		case zm := <-h.broadcast:
+			var ev *musebot.Event
+			if musebot.IsEphemeralEvent(zm.message.Type) {
+				ev = newEphemeralEvent(zm.zone, zm.message)
+			} else {
+				ev = h.newEvent(zm.zone, zm.message)
+				h.remember("", ev)
+			}
 			for c := range h.connections {
-				select {
-				case c.send <- m:
-				default:
-					delete(h.connections, c)
-					safeClose(c.send)
-					go c.ws.Close()
+				if c.follows(zm.zone) {
+					h.deliver(c, ev)
 				}
 			}
 		case m := <-h.broadcastUser:
+			ev := h.newEvent("", m.message)
+			h.remember(m.user, ev)
 			for c := range h.connections {
 				if c.user != m.user {
-					log.Println(c.user, m.user)
 					continue
 				}
-				select {
-				case c.send <- m.message:
-				default:
-					delete(h.connections, c)
-					safeClose(c.send)
-					go c.ws.Close()
-				}
+				h.deliver(c, ev)
 			}
+		case d := <-h.direct:
+			if h.connections[d.conn] {
+				h.deliver(d.conn, newEphemeralEvent("", d.message))
+			}
+		case done := <-h.closeAll:
+			// they'll be sent whatever's still waiting first
+			for c := range h.connections {
+				delete(h.connections, c)
+				safeClose(c.send)
+			}
+			done <- true
 		}
+		wsConnections.Set(float64(len(h.connections)))
+	}
+}
+
+// legacyEventText renders an event the way the websocket used to, before
+// events were JSON: "TYPE", "TYPE <payload>", or for playlist additions
+// "PLAYLIST_ADD <position> <song>".
+func legacyEventText(ev *musebot.Event) string {
+	switch p := ev.Payload.(type) {
+	case nil:
+		return ev.Type
+	case musebot.PlaybackStateChangeEvent:
+		return ev.Type + " " + p.State
+	case musebot.PlaylistAddEvent:
+		b, _ := json.Marshal(p.Song)
+		return ev.Type + " " + strconv.Itoa(p.Position) + " " + string(b)
+	case musebot.PlaylistRemoveEvent:
+		return ev.Type + " " + strconv.Itoa(p.Id)
+	}
+	b, _ := json.Marshal(ev.Payload)
+	return ev.Type + " " + string(b)
+}
+
+func encodeEvent(ev *musebot.Event, legacy bool) (string, error) {
+	if legacy {
+		return legacyEventText(ev), nil
 	}
+	b, err := json.Marshal(ev)
+	return string(b), err
 }
 
+func parseSince(s string) int64 {
+	since, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || since < 0 {
+		return -1
+	}
+	return since
+}
+
+// how many commands one websocket can have running at once; it stops reading
+// any more until one of them finishes
+const maxConcurrentCommands = 4
+
+var errForeignOrigin = errors.New("Websockets can only be opened from MuseBot's own pages.")
+
+// connection is anything following the hub: a websocket, or an event stream.
 type connection struct {
-	ws   *websocket.Conn
-	user string
-	send chan string
+	ws       *websocket.Conn // nil unless it's a websocket
+	commands chan bool       // one for each command running
+	hangUp   func()          // disconnects the client
+	user     string
+	session  *sessions.Session
+	legacy   bool            // speaks the old plain text protocol
+	since    int64           // sequence number the client has seen up to, or -1
+	zones    map[string]bool // the zones it follows, or nil for all of them
+	send     chan *musebot.Event
+
+	// only the hub touches these
+	snapshotting int              // how many lots of snapshots are being built for it
+	held         []*musebot.Event // what's waiting for them
+}
+
+// follows says whether c wants events about zone. Only the hub may call it
+// once c's registered.
+func (c *connection) follows(zone string) bool {
+	return len(zone) == 0 || c.zones == nil || c.zones[zone]
+}
+
+// wsCommand is what clients send up the websocket to call an API method. Args
+// are the same as the HTTP API's form values.
+type wsCommand struct {
+	Id      string
+	Command string
+	Args    map[string]string
+}
+
+func (c *connection) reply(cmd wsCommand, resp musebot.ApiResponse) {
+	h.direct <- directMessage{c, musebot.SystemMessage{musebot.EventCommandReply, musebot.CommandReplyEvent{cmd.Id, cmd.Command, resp}}}
+}
+
+func (c *connection) run(cmd wsCommand) {
+	// which zones to follow is up to each connection
+	if cmd.Command == "subscribe" {
+		zones, err := parseZoneList(cmd.Args["zones"])
+		if err != nil {
+			c.reply(cmd, wrapApiError(err))
+			return
+		}
+		h.subscribe <- subscription{c, zones}
+		c.reply(cmd, musebot.SubscribedApiResponse{zoneListNames(zones)})
+		return
+	}
+
+	fn, ok := wsCommands[cmd.Command]
+	if !ok {
+		c.reply(cmd, wrapApiError(errors.New("There's no such command as '"+cmd.Command+"'.")))
+		return
+	}
+
+	params := url.Values{}
+	for k, v := range cmd.Args {
+		params.Set(k, v)
+	}
+	ar := newApiRequest(params, c.session, newRequestId(), wsLog)
+	ar.log.Debug("Websocket command", "command", cmd.Command)
+	c.reply(cmd, fn(ar))
+}
+
+func (c *connection) reader() {
+	for {
+		var message string
+		err := websocket.Message.Receive(c.ws, &message)
+		if err != nil {
+			break
+		}
+
+		cmd := wsCommand{}
+		err = json.Unmarshal([]byte(message), &cmd)
+		if err != nil {
+			c.reply(cmd, wrapApiError(errors.New("Commands must be JSON objects.")))
+			continue
+		}
+
+		// some commands (like fetching songs) take a while
+		c.commands <- true
+		go func() {
+			defer func() { <-c.commands }()
+			c.run(cmd)
+		}()
+	}
+	h.unregister <- c
 }
 
 func (c *connection) writer() {
-	for message := range c.send {
-		err := websocket.Message.Send(c.ws, message)
+	for ev := range c.send {
+		message, err := encodeEvent(ev, c.legacy)
+		if err != nil {
+			continue
+		}
+		err = websocket.Message.Send(c.ws, message)
 		if err != nil {
 			break
 		}
@@ -94,30 +486,69 @@ func (c *connection) writer() {
 }
 
 func wsHandler(ws *websocket.Conn) {
-	// check that they're logged in!
 	httpRequest := ws.Request()
+	legacy := httpRequest.FormValue("format") == "text"
+
+	// check that they're logged in!
 	session := getSession(httpRequest)
 	if !isLoggedIn(session) {
-		websocket.Message.Send(ws, "NOT_LOGGED_IN")
+		message, _ := encodeEvent(&musebot.Event{Version: musebot.EventProtocolVersion, Type: musebot.EventNotLoggedIn, Timestamp: time.Now()}, legacy)
+		websocket.Message.Send(ws, message)
+		ws.Close()
+		return
+	}
+
+	// clients which have been here before can tell us where they got up to
+	since := parseSince(httpRequest.FormValue("since"))
+
+	following, err := parseZoneList(httpRequest.FormValue("zones"))
+	if err != nil {
+		message, _ := encodeEvent(&musebot.Event{Version: musebot.EventProtocolVersion, Type: musebot.EventCommandReply, Timestamp: time.Now(), Payload: wrapApiError(err)}, legacy)
+		websocket.Message.Send(ws, message)
 		ws.Close()
 		return
 	}
 
-	c := &connection{send: make(chan string, 256), ws: ws, user: session.Values["username"].(string)}
+	// leave enough room to replay everything we remember
+	c := &connection{send: make(chan *musebot.Event, h.historySize+256), ws: ws, commands: make(chan bool, maxConcurrentCommands), hangUp: func() { ws.Close() }, user: session.Values["username"].(string), session: session, legacy: legacy, since: since, zones: following}
+	wsLog.Debug("Websocket connected", "user", c.user, "legacy", legacy, "since", since)
 	h.register <- c
-	defer func() { h.unregister <- c }()
+	defer func() {
+		h.unregister <- c
+		wsLog.Debug("Websocket disconnected", "user", c.user)
+	}()
+	go c.reader()
 	c.writer()
 }
 
-func registerWsHandler() {
-	http.Handle("/ws", websocket.Handler(wsHandler))
+// checkOrigin turns away websockets opened by other sites' pages, which would
+// otherwise get to send commands with the cookies of whoever's visiting them.
+// Browsers always say where they've come from; other clients needn't.
+func checkOrigin(config *websocket.Config, r *http.Request) error {
+	if len(r.Header.Get("Origin")) == 0 {
+		return nil
+	}
+	origin, err := url.ParseRequestURI(r.Header.Get("Origin"))
+	if err != nil || !strings.EqualFold(origin.Host, r.Host) {
+		wsLog.Warn("Refusing a websocket from another site", "origin", r.Header.Get("Origin"), "host", r.Host)
+		return errForeignOrigin
+	}
+	config.Origin = origin
+	return nil
+}
+
+func registerWsHandler(cfg *musebot.JsonCfg) {
+	h.historySize = cfg.EventBufferSize
+	if h.historySize <= 0 {
+		h.historySize = 500
+	}
+
+	http.Handle("/ws", websocket.Server{Handshake: checkOrigin, Handler: wsHandler})
 
 	go h.run()
 
 	// also:
-	go func(provider chan string, websocketbroadcast chan string) {
-		for {
-			websocketbroadcast <- <-provider
-		}
-	}(backendPipe, h.broadcast)
+	for _, z := range zones {
+		go forwardBackendMessages(z, h.broadcast)
+	}
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"musebot"
+	"strings"
+)
+
+// zone is somewhere music plays: a backend with a queue of its own, and
+// everything keeping an eye on it.
+type zone struct {
+	name     string
+	backend  musebot.Backend
+	pipe     chan musebot.BackendMessage
+	autoplay *autoplayer // nil if autoplay's turned off
+}
+
+var zones = make(map[string]*zone)
+var zoneOrder []string // as they were configured
+var defaultZone *zone
+
+var errNoSuchZone = errors.New("There's no zone with that name.")
+
+func lookupZone(name string) (*zone, error) {
+	if len(name) == 0 {
+		return defaultZone, nil
+	}
+	z, ok := zones[name]
+	if !ok {
+		return nil, errNoSuchZone
+	}
+	return z, nil
+}
+
+// zone is the zone an API call is about, from its "zone" argument. Zones
+// following a party leader are stood in for by the leader.
+func (ar *apiRequest) zone() (*zone, error) {
+	z, err := lookupZone(ar.get("zone"))
+	if err != nil {
+		return nil, err
+	}
+	return linkedZones.leaderFor(z), nil
+}
+
+// parseZoneList reads a comma-separated list of zones to follow. Empty means
+// all of them.
+func parseZoneList(s string) (map[string]bool, error) {
+	if len(strings.TrimSpace(s)) == 0 {
+		return nil, nil
+	}
+	out := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := zones[name]; !ok {
+			return nil, errors.New("There's no zone called '" + name + "'.")
+		}
+		out[name] = true
+	}
+	return out, nil
+}
+
+func zoneListNames(following map[string]bool) []string {
+	out := make([]string, 0, len(following))
+	for _, name := range zoneOrder {
+		if following[name] {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+func registerZoneApi() {
+	handleApi("/api/zones/", "zones", func(ar *apiRequest) musebot.ApiResponse {
+		resp := musebot.ZonesApiResponse{Zones: make([]musebot.ZoneStatus, 0, len(zoneOrder)), Default: defaultZone.name}
+		for _, name := range zoneOrder {
+			status := musebot.ZoneStatus{Name: name}
+			if song, isPlaying, err := zones[name].backend.CurrentSong(); err == nil && isPlaying {
+				status.Playing = true
+				status.CurrentSong = &song
+			}
+			resp.Zones = append(resp.Zones, status)
+		}
+		return resp
+	})
+}
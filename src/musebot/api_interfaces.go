@@ -1,5 +1,7 @@
 package musebot
 
+import "time"
+
 type ApiResponse interface{}
 
 type CurrentSongApiResponse struct {
@@ -20,12 +22,54 @@ type ErrorApiResponse struct {
 	Error string
 }
 
+type ProviderHealth struct {
+	Healthy             bool
+	LastError           string
+	LastChecked         time.Time
+	ConsecutiveFailures int
+	NextRetry           *time.Time // only set when unhealthy
+}
+
+// HealthCheckResult only says whether a check passed; why it didn't goes in
+// the logs, since anyone can ask.
+type HealthCheckResult struct {
+	Name string
+	Ok   bool
+}
+
+type LivenessApiResponse struct {
+	Alive bool
+}
+
+// ReadinessApiResponse says whether we're ready to serve requests, and if
+// not, what isn't.
+type ReadinessApiResponse struct {
+	Ready  bool
+	Checks []HealthCheckResult
+}
+
 type AvailableProvidersApiResponse struct {
-	Providers map[string]string
+	Providers          map[string]string // only those which are currently healthy
+	SearchCapabilities map[string]SearchCapabilities
+	Health             map[string]ProviderHealth // every configured provider
+}
+
+type SearchPaging struct {
+	Offset  int
+	Limit   int
+	Total   int // -1 if it isn't known
+	HasMore bool
 }
 
 type SearchResultsApiResponse struct {
 	Results []SongInfo
+	SearchPaging
+}
+
+type FederatedSearchResultsApiResponse struct {
+	Results  []FederatedSongInfo
+	Failures map[string]string // provider package name -> error
+	SearchPaging
 }
 
 type LoggedInApiResponse struct {
@@ -36,11 +80,116 @@ type LoggedOutApiResponse struct {
 	LoggedOut bool
 }
 
+type ShuttingDownApiResponse struct {
+	Reason string
+}
+
 type JobQueuedApiResponse struct {
 	JobId string
 }
 
+type JobStatus struct {
+	JobId    string
+	Zone     string
+	Song     SongInfo
+	Playlist string                 // set instead of Song for jobs queueing a whole saved playlist
+	Progress map[string]interface{} // the latest content of each type of ProviderMessage
+}
+
 type JobWebSocketApiResponse struct {
 	JobId string
 	Data  interface{}
 }
+
+type VotedApiResponse struct {
+	SongId       string
+	VotedAgainst []string
+	Threshold    int
+	Removed      bool // whether that was the last straw
+}
+
+type TransportApiResponse struct {
+	Action string
+}
+
+type PongApiResponse struct {
+	Time time.Time
+}
+
+type HistoryApiResponse struct {
+	Entries []HistoryEntry // newest first
+	SearchPaging
+}
+
+type StatsApiResponse struct {
+	HistoryStats
+}
+
+type SavedPlaylistsApiResponse struct {
+	Playlists []SavedPlaylist
+}
+
+type SavedPlaylistApiResponse struct {
+	Playlist SavedPlaylist
+}
+
+type PlaylistDeletedApiResponse struct {
+	Name string
+}
+
+type ImportFailure struct {
+	Entry int // counting from 0, in the order they were in the file
+	Item  PlaylistItem
+	Error string
+}
+
+type ImportApiResponse struct {
+	Imported int
+	Failures []ImportFailure
+	Playlist *SavedPlaylist // when importing into a saved playlist
+	JobId    string         // when importing into the queue
+}
+
+type BlocklistApiResponse struct {
+	Rules []BlocklistRule
+}
+
+type BlocklistRuleApiResponse struct {
+	Rule BlocklistRule
+}
+
+type ScheduleRuleStatus struct {
+	ScheduleRuleCfg
+	Active bool
+}
+
+type ScheduleApiResponse struct {
+	Rules []ScheduleRuleStatus
+}
+
+type VolumeApiResponse struct {
+	Volume    int
+	MaxVolume int // 0 unless the schedule is capping the volume
+}
+
+type ZoneStatus struct {
+	Name        string
+	Playing     bool
+	CurrentSong *SongInfo
+}
+
+type ZonesApiResponse struct {
+	Zones   []ZoneStatus
+	Default string
+}
+
+// PartyApiResponse describes the zones linked together, if any. Everything
+// asked of a follower is done to the leader instead.
+type PartyApiResponse struct {
+	Leader string
+	Zones  []string
+}
+
+type SubscribedApiResponse struct {
+	Zones []string // empty means every zone
+}
@@ -6,20 +6,17 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"log"
+	"math"
 	//"mpd"
 	"musebot"
+	"musebot/logging"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-var lastPlaylistVersion uint32
-var lastPlaylistLength uint32
-var lastPlaylist []musebot.SongInfo
-var lastPlaybackState string
-
 func constructSongInfo(songDetails mpd.Attrs, m *MpdBackend) *musebot.SongInfo {
 	length, _ := strconv.ParseInt(songDetails["Time"], 10, 0)
 
@@ -38,7 +35,7 @@ func constructSongInfo(songDetails mpd.Attrs, m *MpdBackend) *musebot.SongInfo {
 		var wasOk bool
 		sdp, wasOk := si.ProviderName.(string)
 		if wasOk {
-			si.Provider, wasOk = musebot.CurrentProviders[sdp]
+			si.Provider, wasOk = musebot.CurrentProvider(sdp)
 		}
 	} else {
 		si.ProviderName = "<<LOCAL>>"
@@ -52,20 +49,47 @@ func constructSongInfo(songDetails mpd.Attrs, m *MpdBackend) *musebot.SongInfo {
 	return &si
 }
 
+var backendLog = logging.New("backend")
+
+// how far, in seconds, playback has to jump before we call it a seek
+const mpdSeekThreshold = 2.0
+
 type MpdBackend struct {
 	client   *mpd.Client
-	commPipe chan string
+	commPipe chan musebot.BackendMessage
+	log      *logging.Logger
+
+	addr             string
+	network          string
+	musicDir         string
+	positionInterval time.Duration
+
+	lastPlaylistVersion uint32
+	lastPlaylistLength  uint32
+	lastPlaylist        []musebot.SongInfo
+	lastPlaybackState   string
 
-	addr     string
-	network  string
-	musicDir string
+	lastSongId        string
+	lastPosition      float64
+	lastPositionState string
+	lastPositionAt    time.Time
+	lastPositionTick  time.Time
+
+	onReconnect func() // set before Setup, so never changes under keepAlive
+
+	holdLock       sync.Mutex // held while adding, too
+	held           bool
+	addedWhileHeld bool
+
+	closing chan bool // closed to stop keepAlive
+	stopped chan bool // closed once it has
 }
 
 func (m *MpdBackend) String() string {
 	return "MPD Backend by Luke Granger-Brown"
 }
 
-func (m *MpdBackend) Setup(cfg map[string]string, commPipe chan string) {
+func (m *MpdBackend) Setup(cfg map[string]string, commPipe chan musebot.BackendMessage) {
 	m.commPipe = commPipe
 
 	addr, ok := cfg["addr"]
@@ -73,6 +97,7 @@ func (m *MpdBackend) Setup(cfg map[string]string, commPipe chan string) {
 		addr = "127.0.0.1:6600"
 	}
 	m.addr = addr
+	m.log = backendLog.With("mpd", addr)
 
 	network, ok := cfg["network"]
 	if !ok {
@@ -82,27 +107,46 @@ func (m *MpdBackend) Setup(cfg map[string]string, commPipe chan string) {
 
 	m.musicDir, ok = cfg["musicDir"]
 	if !ok {
-		log.Fatalln("musicDir must be specified for the MPD Backend.")
+		m.log.Fatal("musicDir must be specified for the MPD Backend.")
+	}
+
+	// milliseconds between POSITION events; 0 turns them off
+	m.positionInterval = time.Second
+	if interval, ok := cfg["positionInterval"]; ok {
+		ms, err := strconv.Atoi(interval)
+		if err != nil {
+			m.log.Fatal("positionInterval must be a number of milliseconds.")
+		}
+		m.positionInterval = time.Duration(ms) * time.Millisecond
 	}
 
 	err := m.connect()
 	if err != nil {
-		log.Fatalln("Error connecting to MPD", err)
+		m.log.Fatal("Error connecting to MPD", "error", err)
 	}
 
+	m.closing = make(chan bool)
+	m.stopped = make(chan bool)
 	go m.keepAlive()
 }
 
+func (m *MpdBackend) Close() error {
+	close(m.closing)
+	<-m.stopped
+	m.log.Info("Disconnecting from MPD")
+	return m.client.Close()
+}
+
 func (m *MpdBackend) connect() error {
 	var err error
 
-	log.Println("   - Connecting to MPD via", m.network, "at address", m.addr)
+	m.log.Info("Connecting to MPD", "network", m.network)
 	m.client, err = mpd.Dial(m.network, m.addr)
 	if err != nil {
 		return err
 	}
 
-	log.Println("   - Connected!")
+	m.log.Info("Connected!")
 
 	m.client.ConsumeMode(true)
 
@@ -112,12 +156,12 @@ func (m *MpdBackend) connect() error {
 	}
 
 	lastPlaylistVersionA, err := strconv.ParseUint(status["playlist"], 10, 32)
-	lastPlaylistVersion = uint32(lastPlaylistVersionA)
+	m.lastPlaylistVersion = uint32(lastPlaylistVersionA)
 
-	lastPlaybackState = status["state"]
-	log.Println("   - MPD playlist version is at: " + status["playlist"])
+	m.lastPlaybackState = status["state"]
+	m.log.Debug("MPD playlist version", "version", status["playlist"])
 
-	lastPlaylist, err = m.PlaybackQueue()
+	m.lastPlaylist, err = m.PlaybackQueue()
 	if err != nil {
 		return err
 	}
@@ -126,11 +170,24 @@ func (m *MpdBackend) connect() error {
 }
 
 func (m *MpdBackend) keepAlive() {
+	defer close(m.stopped)
 	for {
+		select {
+		case <-m.closing:
+			return
+		default:
+		}
+
 		status, err := m.client.Status()
 		if err != nil {
-			log.Println("MPD: Keep alive returned error. Reconnecting!")
-			m.connect()
+			m.log.Warn("Keep alive returned error. Reconnecting!", "error", err)
+			if m.onReconnect != nil {
+				m.onReconnect()
+			}
+			if m.connect() != nil {
+				time.Sleep(time.Second)
+			}
+			continue
 		}
 
 		m.client.ConsumeMode(true)
@@ -143,23 +200,25 @@ func (m *MpdBackend) keepAlive() {
 		newLastPlaylistLength := uint32(lastPlaylistLengthA)
 
 		newPlaybackState := status["state"]
-		if newPlaybackState != lastPlaybackState {
-			m.commPipe <- "PLAYBACK_STATE_CHANGE " + newPlaybackState
-			lastPlaybackState = newPlaybackState
+		if newPlaybackState != m.lastPlaybackState {
+			m.commPipe <- musebot.BackendMessage{musebot.EventPlaybackStateChange, musebot.PlaybackStateChangeEvent{newPlaybackState}}
+			m.lastPlaybackState = newPlaybackState
 		}
 
-		if newLastPlaylistVersion != lastPlaylistVersion {
+		m.checkSongAndPosition(status)
+
+		if newLastPlaylistVersion != m.lastPlaylistVersion {
 			// okay, so it's different
 			newPlaylist, err := m.PlaybackQueue()
 			if err != nil {
-				m.commPipe <- "RELOAD_PLAYLIST"
+				m.commPipe <- musebot.BackendMessage{musebot.EventReloadPlaylist, nil}
 				continue
 			}
 
 			// plchangespos ONLY LISTS NEW SONGS
 			maxNum := len(newPlaylist)
-			if len(lastPlaylist) > maxNum {
-				maxNum = len(lastPlaylist)
+			if len(m.lastPlaylist) > maxNum {
+				maxNum = len(m.lastPlaylist)
 			}
 
 			//removedSongs := make([]musebot.SongInfo, maxNum)
@@ -174,8 +233,8 @@ func (m *MpdBackend) keepAlive() {
 				songIsNew := true
 				currentLookupSong := newPlaylist[i]
 
-				for k := 0; k < len(lastPlaylist); k++ {
-					if lastPlaylist[k].Id == currentLookupSong.Id {
+				for k := 0; k < len(m.lastPlaylist); k++ {
+					if m.lastPlaylist[k].Id == currentLookupSong.Id {
 						songIsNew = false
 						break
 					}
@@ -186,9 +245,9 @@ func (m *MpdBackend) keepAlive() {
 					addedSongsI++
 				}
 			}
-			for i := 0; i < len(lastPlaylist); i++ {
+			for i := 0; i < len(m.lastPlaylist); i++ {
 				songIsGone := true
-				currentLookupSong := lastPlaylist[i]
+				currentLookupSong := m.lastPlaylist[i]
 
 				for k := 0; k < len(newPlaylist); k++ {
 					if newPlaylist[k].Id == currentLookupSong.Id {
@@ -205,28 +264,69 @@ func (m *MpdBackend) keepAlive() {
 			}
 
 			for i := 0; i < addedSongsI; i++ {
-				b, err := json.Marshal(addedSongs[i])
-				if err != nil {
-					m.commPipe <- "RELOAD_PLAYLIST"
-					break
-				}
-				m.commPipe <- "PLAYLIST_ADD " + strconv.Itoa(addedSongsPos[i]) + " " + string(b)
+				m.commPipe <- musebot.BackendMessage{musebot.EventPlaylistAdd, musebot.PlaylistAddEvent{addedSongsPos[i], addedSongs[i]}}
 			}
 
 			for i := 0; i < removedSongsI; i++ {
-				m.commPipe <- "PLAYLIST_REMOVE " + strconv.Itoa(removedSongsId[i])
+				m.commPipe <- musebot.BackendMessage{musebot.EventPlaylistRemove, musebot.PlaylistRemoveEvent{removedSongsId[i]}}
 			}
 
-			lastPlaylist = newPlaylist
+			m.lastPlaylist = newPlaylist
 		}
 
-		lastPlaylistVersion = newLastPlaylistVersion
-		lastPlaylistLength = newLastPlaylistLength
+		m.lastPlaylistVersion = newLastPlaylistVersion
+		m.lastPlaylistLength = newLastPlaylistLength
 
 		time.Sleep(20 * time.Millisecond)
 	}
 }
 
+// checkSongAndPosition notices the song changing or being seeked within, and
+// reports where we are in the current song every positionInterval.
+func (m *MpdBackend) checkSongAndPosition(status mpd.Attrs) {
+	now := time.Now()
+	state := status["state"]
+	songId := status["songid"]
+	if state != "play" && state != "pause" {
+		songId = ""
+	}
+	position, _ := strconv.ParseFloat(status["elapsed"], 64)
+
+	if songId != m.lastSongId {
+		var song *musebot.SongInfo
+		if len(songId) != 0 {
+			si, isPlaying, err := m.CurrentSong()
+			if err == nil && isPlaying {
+				song = &si
+			}
+		}
+		m.commPipe <- musebot.BackendMessage{musebot.EventSongChanged, musebot.SongChangedEvent{song}}
+		m.lastSongId = songId
+	} else if len(songId) != 0 {
+		expected := m.lastPosition
+		if m.lastPositionState == "play" {
+			expected += now.Sub(m.lastPositionAt).Seconds()
+		}
+		if math.Abs(position-expected) > mpdSeekThreshold {
+			m.commPipe <- musebot.BackendMessage{musebot.EventSeeked, musebot.SeekedEvent{songId, expected, position}}
+		}
+	}
+
+	m.lastPosition = position
+	m.lastPositionState = state
+	m.lastPositionAt = now
+
+	if m.positionInterval > 0 && state == "play" && now.Sub(m.lastPositionTick) >= m.positionInterval {
+		// "time" is "elapsed:total", in whole seconds
+		length := 0
+		if parts := strings.SplitN(status["time"], ":", 2); len(parts) == 2 {
+			length, _ = strconv.Atoi(parts[1])
+		}
+		m.commPipe <- musebot.BackendMessage{musebot.EventPosition, musebot.PositionEvent{songId, position, length, state}}
+		m.lastPositionTick = now
+	}
+}
+
 func (m *MpdBackend) ifNotPlayingEmptyQueue() {
 	// grab current info
 	currentInfo, err := m.client.Status()
@@ -238,15 +338,38 @@ func (m *MpdBackend) ifNotPlayingEmptyQueue() {
 }
 
 func (m *MpdBackend) Add(s musebot.SongInfo) error {
-	m.ifNotPlayingEmptyQueue()
+	m.holdLock.Lock()
+	defer m.holdLock.Unlock()
+
+	// anything added while playback's held is waiting its turn, not old news
+	if !m.addedWhileHeld {
+		m.ifNotPlayingEmptyQueue()
+	}
+
+	err := m.add(s)
+	if m.held {
+		m.addedWhileHeld = m.addedWhileHeld || err == nil
+	} else {
+		m.forcePlayback()
+	}
+	return err
+}
 
+func (m *MpdBackend) Enqueue(s musebot.SongInfo) error {
+	m.holdLock.Lock()
+	defer m.holdLock.Unlock()
+	return m.add(s)
+}
+
+// add puts s on the end of the queue, and nothing else.
+func (m *MpdBackend) add(s musebot.SongInfo) error {
 	// here goes
 	path := s.MusicUrl
 
 	// this should be a local filesystem path by now...
 	if len(path) == 0 || path[0] != '/' {
 		err := errors.New("MpdBackend: path invalid for song with path " + path)
-		log.Println("Error adding song to queue: non-absolute path!", err)
+		m.log.Error("Error adding song to queue: non-absolute path!", "error", err)
 		return err
 	}
 
@@ -262,14 +385,12 @@ func (m *MpdBackend) Add(s musebot.SongInfo) error {
 	}
 	s.MusicUrl = s.MusicUrl[len(m.musicDir):]
 
-	log.Println(s)
-	log.Println(s.MusicUrl)
-
-	// defer this
-	defer m.forcePlayback()
+	m.log.Debug("Adding to the queue", "title", s.Title, "path", s.MusicUrl)
 
-	s.ProviderName = s.Provider.PackageName()
-	s.Provider = nil
+	if s.Provider != nil {
+		s.ProviderName = s.Provider.PackageName()
+		s.Provider = nil
+	}
 	jsonS, err := json.Marshal(s)
 
 	m.client.Update(s.MusicUrl)
@@ -281,10 +402,73 @@ func (m *MpdBackend) Add(s musebot.SongInfo) error {
 	return m.client.Add(s.MusicUrl)
 }
 
+func (m *MpdBackend) HoldPlayback(hold bool) error {
+	m.holdLock.Lock()
+	defer m.holdLock.Unlock()
+
+	m.held = hold
+	if hold || !m.addedWhileHeld {
+		return nil
+	}
+	m.addedWhileHeld = false
+	return m.client.Play(-1)
+}
+
 func (m *MpdBackend) forcePlayback() {
 	m.client.Play(-1)
 }
 
+func (m *MpdBackend) Play() error {
+	return m.client.Play(-1)
+}
+
+func (m *MpdBackend) Pause() error {
+	return m.client.Pause(true)
+}
+
+func (m *MpdBackend) Stop() error {
+	return m.client.Stop()
+}
+
+func (m *MpdBackend) Next() error {
+	return m.client.Next()
+}
+
+func (m *MpdBackend) Seek(s musebot.SongInfo, position float64) error {
+	intId, _ := strconv.ParseInt(s.Id, 10, 0)
+	// MPD only seeks to whole seconds
+	return m.client.SeekId(int(intId), int(position+0.5))
+}
+
+func (m *MpdBackend) HealthCheck() error {
+	_, err := m.client.Status()
+	return err
+}
+
+func (m *MpdBackend) OnReconnect(fn func()) {
+	m.onReconnect = fn
+}
+
+func (m *MpdBackend) MusicDir() string {
+	return m.musicDir
+}
+
+func (m *MpdBackend) Volume() (int, error) {
+	status, err := m.client.Status()
+	if err != nil {
+		return -1, err
+	}
+	volume, err := strconv.Atoi(status["volume"])
+	if err != nil {
+		return -1, nil // no mixer
+	}
+	return volume, nil
+}
+
+func (m *MpdBackend) SetVolume(volume int) error {
+	return m.client.SetVolume(volume)
+}
+
 func (m *MpdBackend) Remove(s musebot.SongInfo) error {
 	intId, _ := strconv.ParseInt(s.Id, 10, 0)
 	return m.client.DeleteId(int(intId))
@@ -293,7 +477,7 @@ func (m *MpdBackend) Remove(s musebot.SongInfo) error {
 func (m *MpdBackend) CurrentSong() (musebot.SongInfo, bool, error) {
 	currentInfo, err := m.client.Status()
 	if err != nil {
-		log.Println("Error fetching status from MPD:", err)
+		m.log.Error("Error fetching status from MPD", "error", err)
 		return musebot.SongInfo{}, false, err
 	}
 
@@ -303,7 +487,7 @@ func (m *MpdBackend) CurrentSong() (musebot.SongInfo, bool, error) {
 
 	songDetails, err := m.client.CurrentSong()
 	if err != nil {
-		log.Println("Error fetching current song from MPD:", err)
+		m.log.Error("Error fetching current song from MPD", "error", err)
 		return musebot.SongInfo{}, false, err
 	}
 
@@ -322,7 +506,7 @@ func (m *MpdBackend) CurrentSong() (musebot.SongInfo, bool, error) {
 func (m *MpdBackend) PlaybackQueue() ([]musebot.SongInfo, error) {
 	currentInfo, err := m.client.Status()
 	if err != nil {
-		log.Println("Error fetching status from MPD:", err)
+		m.log.Error("Error fetching status from MPD", "error", err)
 		return make([]musebot.SongInfo, 0), err
 	}
 
@@ -333,7 +517,7 @@ func (m *MpdBackend) PlaybackQueue() ([]musebot.SongInfo, error) {
 
 		songPos, err := strconv.ParseInt(currentInfo["song"], 10, 0)
 		if err != nil {
-			log.Println("Error converting number to integer:", err)
+			m.log.Error("Error converting number to integer", "error", err)
 			return nil, err
 		}
 		currentPos = songPos
@@ -341,13 +525,13 @@ func (m *MpdBackend) PlaybackQueue() ([]musebot.SongInfo, error) {
 
 	playlistLength, err := strconv.ParseInt(currentInfo["playlistlength"], 10, 0)
 	if err != nil {
-		log.Println("Error converting number to integer:", err)
+		m.log.Error("Error converting number to integer", "error", err)
 		return nil, err
 	}
 
 	songInfo, err := m.client.PlaylistInfo(int(currentPos), int(playlistLength))
 	if err != nil {
-		log.Println("Error fetching playlist from MPD:", err)
+		m.log.Error("Error fetching playlist from MPD", "error", err)
 		return nil, err
 	}
 
@@ -0,0 +1,21 @@
+package musebot
+
+import "time"
+
+// BlocklistRule keeps songs matching Pattern out of the queue. At search
+// time, matches are either hidden or flagged, depending on Action.
+type BlocklistRule struct {
+	Id      int
+	Field   string // "artist", "title", "album", "provider_id" or "any"
+	Pattern string
+	Match   string // "glob" (the default), "regex" or "exact"
+	Action  string // "hide" (the default) or "flag"
+	Reason  string
+	AddedBy string
+	Added   time.Time
+}
+
+type BlockedSongInfo struct {
+	RuleId int
+	Reason string
+}
@@ -0,0 +1,222 @@
+// Package blocklist keeps track of songs which shouldn't be played, by
+// artist, title, album or provider ID.
+package blocklist
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"musebot"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoSuchRule   = errors.New("There's no blocklist rule with that ID.")
+	ErrBadField     = errors.New("Blocklist rules can only match on artist, title, album, provider_id or any.")
+	ErrBadMatch     = errors.New("Blocklist rules can only be glob, regex or exact matches.")
+	ErrBadAction    = errors.New("Blocklist rules can only hide or flag songs.")
+	ErrEmptyPattern = errors.New("Blocklist rules need a pattern.")
+)
+
+type compiledRule struct {
+	rule musebot.BlocklistRule
+	re   *regexp.Regexp
+}
+
+// Store keeps the blocklist in memory and in a JSON file which is rewritten
+// whenever it changes.
+type Store struct {
+	sync.Mutex
+	path   string
+	rules  []compiledRule
+	nextId int
+}
+
+// globToRegexp turns a shell-style glob into an anchored regular expression.
+func globToRegexp(glob string) string {
+	var buf bytes.Buffer
+	buf.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			buf.WriteString(".*")
+		case '?':
+			buf.WriteString(".")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	buf.WriteString("$")
+	return buf.String()
+}
+
+// compile checks rule over, filling in defaults. Everything is matched
+// ignoring case.
+func compile(rule musebot.BlocklistRule) (compiledRule, error) {
+	rule.Pattern = strings.TrimSpace(rule.Pattern)
+	if len(rule.Pattern) == 0 {
+		return compiledRule{}, ErrEmptyPattern
+	}
+
+	switch rule.Field {
+	case "":
+		rule.Field = "any"
+	case "artist", "title", "album", "provider_id", "any":
+	default:
+		return compiledRule{}, ErrBadField
+	}
+
+	switch rule.Action {
+	case "":
+		rule.Action = "hide"
+	case "hide", "flag":
+	default:
+		return compiledRule{}, ErrBadAction
+	}
+
+	var expr string
+	switch rule.Match {
+	case "", "glob":
+		rule.Match = "glob"
+		expr = globToRegexp(rule.Pattern)
+	case "exact":
+		expr = "^" + regexp.QuoteMeta(rule.Pattern) + "$"
+	case "regex":
+		expr = rule.Pattern
+	default:
+		return compiledRule{}, ErrBadMatch
+	}
+
+	re, err := regexp.Compile("(?i)" + expr)
+	if err != nil {
+		return compiledRule{}, errors.New("That isn't a valid regular expression: " + err.Error())
+	}
+	return compiledRule{rule, re}, nil
+}
+
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, rules: make([]compiledRule, 0)}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var saved []musebot.BlocklistRule
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return nil, err
+	}
+	for _, rule := range saved {
+		cr, err := compile(rule)
+		if err != nil {
+			return nil, errors.New("Blocklist rule " + rule.Pattern + ": " + err.Error())
+		}
+		s.rules = append(s.rules, cr)
+		if rule.Id >= s.nextId {
+			s.nextId = rule.Id + 1
+		}
+	}
+	return s, nil
+}
+
+func (s *Store) save() error {
+	b, err := json.MarshalIndent(s.list(), "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.path+".tmp", b, 0666); err != nil {
+		return err
+	}
+	return os.Rename(s.path+".tmp", s.path)
+}
+
+func (s *Store) list() []musebot.BlocklistRule {
+	out := make([]musebot.BlocklistRule, 0, len(s.rules))
+	for _, cr := range s.rules {
+		out = append(out, cr.rule)
+	}
+	return out
+}
+
+func (s *Store) List() []musebot.BlocklistRule {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.list()
+}
+
+// Add checks rule over and adds it, returning it as it was saved.
+func (s *Store) Add(rule musebot.BlocklistRule) (musebot.BlocklistRule, error) {
+	cr, err := compile(rule)
+	if err != nil {
+		return rule, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	cr.rule.Id = s.nextId
+	cr.rule.Added = time.Now()
+	s.nextId++
+	s.rules = append(s.rules, cr)
+	return cr.rule, s.save()
+}
+
+func (s *Store) Remove(id int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for i, cr := range s.rules {
+		if cr.rule.Id == id {
+			s.rules = append(s.rules[:i], s.rules[i+1:]...)
+			return s.save()
+		}
+	}
+	return ErrNoSuchRule
+}
+
+func (cr compiledRule) matches(si musebot.SongInfo) bool {
+	fields := map[string]string{
+		"artist":      si.Artist,
+		"title":       si.Title,
+		"album":       si.Album,
+		"provider_id": si.ProviderId,
+	}
+	if cr.rule.Field != "any" {
+		return cr.re.MatchString(fields[cr.rule.Field])
+	}
+	for _, v := range fields {
+		if cr.re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns the rule si falls foul of, if there is one. Rules which hide
+// songs win over ones which only flag them.
+func (s *Store) Match(si musebot.SongInfo) (musebot.BlocklistRule, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	var found *musebot.BlocklistRule
+	for i := range s.rules {
+		if !s.rules[i].matches(si) {
+			continue
+		}
+		if found == nil || (found.Action != "hide" && s.rules[i].rule.Action == "hide") {
+			found = &s.rules[i].rule
+		}
+	}
+	if found == nil {
+		return musebot.BlocklistRule{}, false
+	}
+	return *found, true
+}
@@ -3,23 +3,127 @@ package musebot
 import (
 	"encoding/json"
 	"io/ioutil"
-	"log"
+	"musebot/logging"
 )
 
 type JsonCfg struct {
 	Backend       string
 	BackendConfig map[string]map[string]string
 
+	// Each zone has a backend of its own. Without any, there's a single zone
+	// called "default" using Backend.
+	Zones       []ZoneCfg
+	DefaultZone string // where API calls which don't name a zone go
+
+	// How far apart, in seconds, zones linked for a party can drift before
+	// they're put back in step (default 2). Only zones with the same music
+	// directory, shared between their backends, can be linked.
+	PartyDriftThreshold float64
+
 	AuthBackend       string
 	AuthBackendConfig map[string]map[string]string
 
 	ProviderBackendConfig map[string]map[string]string
 	DefaultProvider       string
+	SearchTimeout         int // seconds each provider gets to answer a federated search
+	ProviderCheckInterval int // seconds between provider health checks
+	ProviderRetryMax      int // longest, in seconds, to wait between attempts to revive a provider
+
+	VoteSkipThreshold int // votes needed to get rid of someone else's song
+
+	HistoryFile string // where to keep track of what's been played; empty turns it off
+
+	PlaylistFile string // where saved playlists are kept; empty turns them off
+
+	QueuePolicy   QueuePolicyCfg
+	BlocklistFile string // where the blocklist is kept; empty turns it off
+
+	Autoplay AutoplayCfg
+
+	Schedule []ScheduleRuleCfg
 
 	SessionStoreAuthKey []byte
 
 	ListenAddr    string
 	SslListenAddr string
+	Tls           TlsCfg
+
+	EventBufferSize int // how many events are kept for clients which reconnect
+
+	ShutdownTimeout int    // seconds to wait for fetches to finish when shutting down (default 30)
+	PendingJobsFile string // where fetches which didn't finish are kept until next time; empty forgets them
+
+	Logging LoggingCfg
+}
+
+// LoggingCfg decides how much gets logged, and how. Subsystems are auth,
+// backend, provider, http and ws, along with main, jobs, autoplay, schedule,
+// party, history, playlists and blocklist.
+type LoggingCfg struct {
+	Format string            // "text" (the default) or "json"
+	Level  string            // "debug", "info" (the default), "warn" or "error"
+	Levels map[string]string // levels for particular subsystems
+}
+
+// TlsCfg is where the HTTPS server gets its certificate from, and whether to
+// trust a proxy in front of us to have done TLS instead.
+type TlsCfg struct {
+	CertFile string // defaults to ssl.pub.pem
+	KeyFile  string // defaults to ssl.priv.pem
+
+	// Get certificates for these domains from Let's Encrypt instead, keeping
+	// them in AcmeCacheDir.
+	AcmeDomains  []string
+	AcmeEmail    string
+	AcmeCacheDir string
+
+	// Requests from these CIDRs saying "X-Forwarded-Proto: https" count as
+	// having come in over HTTPS. With any, the HTTPS server is optional.
+	TrustedProxies []string
+
+	RedirectHttp bool // send plain HTTP requests over to HTTPS
+}
+
+type ZoneCfg struct {
+	Name          string
+	Backend       string
+	BackendConfig map[string]string
+}
+
+// QueuePolicyCfg limits what people can queue; zero turns each rule off.
+// Administrators aren't bound by any of it.
+type QueuePolicyCfg struct {
+	MaxQueuedPerUser int // songs each person can have waiting at once
+	RepeatMinutes    int // how long before a song can be queued again after it's played
+	MaxLength        int // longest song anyone can queue, in seconds
+	CooldownSeconds  int // how long people have to wait between queueing songs
+}
+
+type AutoplayCfg struct {
+	Enabled bool
+
+	// Where to look for something to play, in order: "history" and/or
+	// "fallback". Defaults to both.
+	Sources []string
+
+	// Songs to fall back on, as "provider.Name:providerId" or absolute paths
+	// to local files.
+	FallbackPlaylist []string
+
+	HistoryDays  int // how far back to look for popular songs (default 30)
+	AvoidMinutes int // don't play anything which played this recently (default 120)
+}
+
+// ScheduleRuleCfg is in force for every minute which matches When, a cron
+// style "minute hour day-of-month month day-of-week" expression.
+type ScheduleRuleCfg struct {
+	Name  string
+	When  string
+	Zones []string // the zones it applies to; all of them if empty
+
+	Quiet            bool   // pause playback, and don't let anyone queue anything
+	MaxVolume        int    // turn the volume down to at most this percentage
+	FallbackPlaylist string // "owner/name" of a saved playlist for autoplay to use instead
 }
 
 func (cfg *JsonCfg) LoadConfiguration() (err error) {
@@ -29,7 +133,7 @@ func (cfg *JsonCfg) LoadConfiguration() (err error) {
 	}
 	err = json.Unmarshal(b, &cfg)
 	if err != nil {
-		log.Fatalln("An error occurred whilst parsing config.json:", err)
+		logging.New("main").Fatal("An error occurred whilst parsing config.json", "error", err)
 	}
 	return nil
 }
@@ -0,0 +1,116 @@
+package musebot
+
+import "time"
+
+// EventProtocolVersion is bumped whenever an event's payload changes in a
+// way that would confuse older clients.
+const EventProtocolVersion = 1
+
+// Event is what gets sent down the websocket (and anything else which follows
+// the hub) for every SystemMessage. Sequence numbers are shared by everyone,
+// so a client will see gaps where events were only meant for someone else.
+type Event struct {
+	Version   int
+	Type      string
+	Zone      string // empty unless it's about one zone in particular
+	Sequence  uint64
+	Timestamp time.Time
+	Payload   interface{}
+}
+
+const (
+	EventNotLoggedIn         = "NOT_LOGGED_IN"
+	EventPlaybackStateChange = "PLAYBACK_STATE_CHANGE"
+	EventPlaylistAdd         = "PLAYLIST_ADD"
+	EventPlaylistRemove      = "PLAYLIST_REMOVE"
+	EventReloadPlaylist      = "RELOAD_PLAYLIST"
+	EventJobData             = "JOB_DATA"
+	EventCommandReply        = "COMMAND_REPLY"
+	EventSnapshot            = "SNAPSHOT"
+	EventSongChanged         = "SONG_CHANGED"
+	EventPosition            = "POSITION"
+	EventSeeked              = "SEEKED"
+	EventScheduleChanged     = "SCHEDULE_CHANGED"
+	EventPartyChanged        = "PARTY_CHANGED"
+	EventShutdown            = "SHUTDOWN"
+)
+
+// IsEphemeralEvent says whether an event is only interesting as it happens.
+// Those don't get sequence numbers and aren't replayed to clients which
+// reconnect.
+func IsEphemeralEvent(eventType string) bool {
+	return eventType == EventPosition || eventType == EventCommandReply
+}
+
+type PlaybackStateChangeEvent struct {
+	State string
+}
+
+type PlaylistAddEvent struct {
+	Position int
+	Song     SongInfo
+}
+
+type PlaylistRemoveEvent struct {
+	Id int
+}
+
+type SongChangedEvent struct {
+	Song *SongInfo // nil when nothing is playing any more
+}
+
+type PositionEvent struct {
+	SongId   string
+	Position float64
+	Length   int
+	State    string
+}
+
+type SeekedEvent struct {
+	SongId string
+	From   float64 // where we'd have expected to be
+	To     float64
+}
+
+// CommandReplyEvent answers a command sent up the websocket. It only goes to
+// the connection which sent the command, so it doesn't get a sequence number.
+type CommandReplyEvent struct {
+	Id       string // whatever the client sent with the command
+	Command  string
+	Response ApiResponse
+}
+
+// SnapshotEvent is sent to clients which connect without being able to pick
+// up where they left off, one for each zone they follow. Its Sequence is
+// that of the last event already reflected in it.
+type SnapshotEvent struct {
+	Playing     bool
+	CurrentSong *SongInfo // including its position
+	Queue       []SongInfo
+	Jobs        []JobStatus // only the connecting user's, in this zone
+}
+
+// ScheduleChangedEvent is sent when a schedule rule comes into or goes out
+// of force.
+type ScheduleChangedEvent struct {
+	Rule   string
+	Zones  []string // every zone if empty
+	Active bool
+
+	Quiet            bool
+	MaxVolume        int
+	FallbackPlaylist string
+}
+
+// ShutdownEvent is the last thing sent before the server goes away. Clients
+// should reconnect once it's back.
+type ShutdownEvent struct {
+	Reason string
+}
+
+// PartyChangedEvent is sent when zones are linked together or unlinked. Leader
+// is empty once the party's over.
+type PartyChangedEvent struct {
+	Leader string
+	Zones  []string // the zones following the leader
+}
@@ -0,0 +1,40 @@
+package musebot
+
+import "time"
+
+type HistoryEntry struct {
+	Id   int
+	Zone string
+
+	Title        string
+	Artist       string
+	Album        string
+	Length       int
+	ProviderName string
+	ProviderId   string
+
+	Culprit      string
+	StartedAt    time.Time
+	EndedAt      *time.Time // nil while it's still playing
+	Completed    bool
+	Skipped      bool
+	VotesAgainst int
+}
+
+type HistoryTally struct {
+	Name  string
+	Plays int
+	Skips int
+}
+
+type HistoryStats struct {
+	Since time.Time
+	Until time.Time
+
+	TopTracks  []HistoryTally
+	TopArtists []HistoryTally
+	TopDJs     []HistoryTally
+
+	MostSkippedTracks []HistoryTally
+	MostSkippedDJs    []HistoryTally
+}
@@ -0,0 +1,213 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"musebot"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrNoSuchEntry = errors.New("That history entry doesn't exist.")
+
+// Store keeps track of everything that's been played. It's kept in memory,
+// and in an append-only file of JSON entries: an entry is written out when
+// its song starts and again when it finishes, and the last copy wins.
+type Store struct {
+	sync.Mutex
+	file    *os.File
+	entries []musebot.HistoryEntry // oldest first, Id is the index
+}
+
+func Open(path string) (*Store, error) {
+	s := &Store{entries: make([]musebot.HistoryEntry, 0)}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		e := musebot.HistoryEntry{}
+		if json.Unmarshal(scanner.Bytes(), &e) != nil || e.Id < 0 {
+			continue // probably a half-written line from a crash
+		}
+		for len(s.entries) <= e.Id {
+			s.entries = append(s.entries, musebot.HistoryEntry{Id: len(s.entries)})
+		}
+		s.entries[e.Id] = e
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	s.file = f
+	return s, nil
+}
+
+func (s *Store) write(e musebot.HistoryEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(b, '\n'))
+	return err
+}
+
+// Start records si starting to play in zone, returning the new entry's Id.
+func (s *Store) Start(zone string, si musebot.SongInfo, startedAt time.Time) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	e := musebot.HistoryEntry{
+		Id:         len(s.entries),
+		Zone:       zone,
+		Title:      si.Title,
+		Artist:     si.Artist,
+		Album:      si.Album,
+		Length:     si.Length,
+		ProviderId: si.ProviderId,
+		StartedAt:  startedAt,
+	}
+	e.ProviderName, _ = si.ProviderName.(string)
+	if si.QueueInfo != nil {
+		e.Culprit = si.QueueInfo.Culprit
+	}
+
+	s.entries = append(s.entries, e)
+	return e.Id, s.write(e)
+}
+
+// Finish records how the entry with the given Id ended.
+func (s *Store) Finish(id int, endedAt time.Time, completed bool, votesAgainst int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if id < 0 || id >= len(s.entries) {
+		return ErrNoSuchEntry
+	}
+
+	e := &s.entries[id]
+	e.EndedAt = &endedAt
+	e.Completed = completed
+	e.Skipped = !completed
+	e.VotesAgainst = votesAgainst
+	return s.write(*e)
+}
+
+// Page returns entries newest first, along with how many there are in total.
+func (s *Store) Page(offset int, limit int) ([]musebot.HistoryEntry, int) {
+	s.Lock()
+	defer s.Unlock()
+
+	out := make([]musebot.HistoryEntry, 0)
+	for i := len(s.entries) - 1 - offset; i >= 0 && (limit <= 0 || len(out) < limit); i-- {
+		out = append(out, s.entries[i])
+	}
+	return out, len(s.entries)
+}
+
+// Since returns every entry which started at or after t, oldest first.
+func (s *Store) Since(t time.Time) []musebot.HistoryEntry {
+	s.Lock()
+	defer s.Unlock()
+
+	first := sort.Search(len(s.entries), func(i int) bool {
+		return !s.entries[i].StartedAt.Before(t)
+	})
+	return append([]musebot.HistoryEntry{}, s.entries[first:]...)
+}
+
+type tallies map[string]*musebot.HistoryTally
+
+func (t tallies) add(name string, skipped bool) {
+	if len(name) == 0 {
+		return
+	}
+	tally, ok := t[name]
+	if !ok {
+		tally = &musebot.HistoryTally{Name: name}
+		t[name] = tally
+	}
+	tally.Plays++
+	if skipped {
+		tally.Skips++
+	}
+}
+
+type tallySorter struct {
+	tallies []musebot.HistoryTally
+	less    func(a, b musebot.HistoryTally) bool
+}
+
+func (ts tallySorter) Len() int           { return len(ts.tallies) }
+func (ts tallySorter) Swap(i, j int)      { ts.tallies[i], ts.tallies[j] = ts.tallies[j], ts.tallies[i] }
+func (ts tallySorter) Less(i, j int) bool { return ts.less(ts.tallies[i], ts.tallies[j]) }
+
+func (t tallies) top(limit int, less func(a, b musebot.HistoryTally) bool) []musebot.HistoryTally {
+	out := make([]musebot.HistoryTally, 0, len(t))
+	for _, tally := range t {
+		out = append(out, *tally)
+	}
+	sort.Sort(tallySorter{out, func(a, b musebot.HistoryTally) bool {
+		if less(a, b) != less(b, a) {
+			return less(a, b)
+		}
+		return a.Name < b.Name
+	}})
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+func byPlays(a, b musebot.HistoryTally) bool { return a.Plays > b.Plays }
+func bySkips(a, b musebot.HistoryTally) bool { return a.Skips > b.Skips }
+
+func withSkips(t tallies) tallies {
+	out := make(tallies)
+	for name, tally := range t {
+		if tally.Skips > 0 {
+			out[name] = tally
+		}
+	}
+	return out
+}
+
+// Stats works out the most played (and most skipped) tracks, artists and DJs
+// for songs which started between since and until, with up to limit of each.
+func (s *Store) Stats(since time.Time, until time.Time, limit int) musebot.HistoryStats {
+	tracks, artists, djs := make(tallies), make(tallies), make(tallies)
+
+	for _, e := range s.Since(since) {
+		if !e.StartedAt.Before(until) {
+			break
+		}
+		tracks.add(e.Artist+" - "+e.Title, e.Skipped)
+		artists.add(e.Artist, e.Skipped)
+		djs.add(e.Culprit, e.Skipped)
+	}
+
+	return musebot.HistoryStats{
+		Since:             since,
+		Until:             until,
+		TopTracks:         tracks.top(limit, byPlays),
+		TopArtists:        artists.top(limit, byPlays),
+		TopDJs:            djs.top(limit, byPlays),
+		MostSkippedTracks: withSkips(tracks).top(limit, bySkips),
+		MostSkippedDJs:    withSkips(djs).top(limit, bySkips),
+	}
+}
+
+func (s *Store) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.file.Close()
+}
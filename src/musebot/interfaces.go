@@ -1,23 +1,68 @@
 package musebot
 
+import (
+	"io"
+	"sync"
+)
+
 type Provider interface {
 	Setup(map[string]string) error
 
 	Name() string
 	PackageName() string
 
-	Search(string) ([]SongInfo, error)
+	SearchCapabilities() SearchCapabilities
+	Search(SearchQuery) (SearchResults, error)
 	UpdateSongInfo(*SongInfo) error
 	FetchSong(*SongInfo, chan ProviderMessage)
 }
 
+// CoverArtFetcher is implemented by providers whose cover art can't be handed
+// straight to clients, because fetching it needs credentials we'd rather keep
+// to ourselves. Their songs' CoverArtUrl comes back through musebot instead;
+// see CoverArtProxyUrl.
+type CoverArtFetcher interface {
+	FetchCoverArt(id string) (io.ReadCloser, string, error) // image, content type
+}
+
+// HealthChecker is implemented by providers and backends which can cheaply
+// check that they're still able to talk to wherever their music comes from,
+// or goes to.
+type HealthChecker interface {
+	HealthCheck() error
+}
+
+// ReconnectNotifier is implemented by backends which keep a connection open,
+// and calls fn whenever it's had to be reopened. It's set before Setup.
+type ReconnectNotifier interface {
+	OnReconnect(fn func())
+}
+
+// MusicLibrary is implemented by backends which play local files out of a
+// directory of their own.
+type MusicLibrary interface {
+	MusicDir() string
+}
+
 type Backend interface {
 	CurrentSong() (SongInfo, bool, error)
 	PlaybackQueue() ([]SongInfo, error)
 	Add(SongInfo) error
+	Enqueue(SongInfo) error // just puts it on the end of the queue, without starting or clearing anything
 	Remove(SongInfo) error
 
-	Setup(map[string]string, chan string)
+	Play() error
+	Pause() error
+	Stop() error
+	Next() error
+	Seek(SongInfo, float64) error // seconds into the song, which must be the current one
+	HoldPlayback(bool) error      // while held, Add doesn't start anything; what it added starts once it's let go
+
+	Volume() (int, error) // percent, or -1 if it can't be changed
+	SetVolume(int) error
+
+	Setup(map[string]string, chan BackendMessage)
+	Close() error // stops keeping an eye on playback, which carries on regardless
 }
 
 type Authenticator interface {
@@ -47,5 +92,42 @@ type BackendMessage SystemMessage
 type Providers map[string]Provider
 
 var CurrentAuthenticator Authenticator
-var CurrentBackend Backend
-var CurrentProviders Providers
+
+// the providers in use, which get swapped for fresh instances when broken
+// ones are brought back
+var currentProviders struct {
+	sync.RWMutex
+	providers Providers
+}
+
+func SetCurrentProviders(providers Providers) {
+	currentProviders.Lock()
+	defer currentProviders.Unlock()
+	currentProviders.providers = providers
+}
+
+// ReplaceCurrentProvider swaps in a new instance of one of the providers in
+// use. Whoever's still got the old one can carry on using it.
+func ReplaceCurrentProvider(name string, p Provider) {
+	currentProviders.Lock()
+	defer currentProviders.Unlock()
+
+	replaced := make(Providers, len(currentProviders.providers))
+	for n, existing := range currentProviders.providers {
+		replaced[n] = existing
+	}
+	replaced[name] = p
+	currentProviders.providers = replaced
+}
+
+// CurrentProviders is every provider in use. It mustn't be changed.
+func CurrentProviders() Providers {
+	currentProviders.RLock()
+	defer currentProviders.RUnlock()
+	return currentProviders.providers
+}
+
+func CurrentProvider(name string) (Provider, bool) {
+	p, ok := CurrentProviders()[name]
+	return p, ok
+}
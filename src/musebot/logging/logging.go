@@ -0,0 +1,222 @@
+// Package logging is a leveled logger which writes key/value pairs along with
+// each message, as text or as JSON. Each part of musebot logs as a subsystem
+// of its own, and how much each one says can be set separately.
+package logging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return "LEVEL(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return Info, errors.New("There's no log level called '" + s + "'.")
+}
+
+var output struct {
+	sync.Mutex
+	w            io.Writer
+	json         bool
+	defaultLevel Level
+	levels       map[string]Level
+}
+
+func init() {
+	output.w = os.Stderr
+	output.defaultLevel = Info
+}
+
+// Configure sets the format ("text" or "json") and how much gets logged:
+// defaultLevel for everything, except the subsystems given their own.
+func Configure(format string, defaultLevel string, levels map[string]string) error {
+	def := Info
+	if len(defaultLevel) != 0 {
+		var err error
+		if def, err = ParseLevel(defaultLevel); err != nil {
+			return err
+		}
+	}
+	bySubsystem := make(map[string]Level)
+	for subsystem, name := range levels {
+		l, err := ParseLevel(name)
+		if err != nil {
+			return err
+		}
+		bySubsystem[subsystem] = l
+	}
+	if format != "" && format != "text" && format != "json" {
+		return errors.New("Logs can only be written as 'text' or 'json'.")
+	}
+
+	output.Lock()
+	output.json = format == "json"
+	output.defaultLevel = def
+	output.levels = bySubsystem
+	output.Unlock()
+	return nil
+}
+
+// SetOutput changes where logs are written; they go to stderr to begin with.
+func SetOutput(w io.Writer) {
+	output.Lock()
+	output.w = w
+	output.Unlock()
+}
+
+// Logger logs for one subsystem, adding the same fields to every message.
+type Logger struct {
+	subsystem string
+	fields    []interface{} // alternating keys and values
+}
+
+func New(subsystem string) *Logger {
+	return &Logger{subsystem: subsystem}
+}
+
+// With is l, adding the given key/value pairs to everything it logs.
+func (l *Logger) With(keyValues ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyValues))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyValues...)
+	return &Logger{l.subsystem, fields}
+}
+
+// Fields is everything l adds to what it logs, for passing on to another
+// subsystem's logger.
+func (l *Logger) Fields() []interface{} {
+	return append([]interface{}{}, l.fields...)
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	output.Lock()
+	defer output.Unlock()
+	min, ok := output.levels[l.subsystem]
+	if !ok {
+		min = output.defaultLevel
+	}
+	return level >= min
+}
+
+func (l *Logger) Debug(msg string, keyValues ...interface{}) {
+	l.log(Debug, msg, keyValues)
+}
+
+func (l *Logger) Info(msg string, keyValues ...interface{}) {
+	l.log(Info, msg, keyValues)
+}
+
+func (l *Logger) Warn(msg string, keyValues ...interface{}) {
+	l.log(Warn, msg, keyValues)
+}
+
+func (l *Logger) Error(msg string, keyValues ...interface{}) {
+	l.log(Error, msg, keyValues)
+}
+
+// Fatal logs msg as an error, then exits.
+func (l *Logger) Fatal(msg string, keyValues ...interface{}) {
+	l.log(Error, msg, keyValues)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, msg string, keyValues []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	now := time.Now()
+	fields := append(append([]interface{}{}, l.fields...), keyValues...)
+
+	output.Lock()
+	defer output.Unlock()
+	if output.json {
+		io.WriteString(output.w, formatJson(now, level, l.subsystem, msg, fields))
+	} else {
+		io.WriteString(output.w, formatText(now, level, l.subsystem, msg, fields))
+	}
+}
+
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func formatText(now time.Time, level Level, subsystem string, msg string, fields []interface{}) string {
+	line := now.Format("2006/01/02 15:04:05") + " " + fmt.Sprintf("%-5s", level) + " [" + subsystem + "] " + msg
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		var value interface{} = "(missing)"
+		if i+1 < len(fields) {
+			value = fieldValue(fields[i+1])
+		}
+		s := fmt.Sprint(value)
+		if len(s) == 0 || strings.ContainsAny(s, " \t\n\"=") {
+			s = strconv.Quote(s)
+		}
+		line += " " + key + "=" + s
+	}
+	return line + "\n"
+}
+
+func formatJson(now time.Time, level Level, subsystem string, msg string, fields []interface{}) string {
+	entry := map[string]interface{}{
+		"time":      now.Format(time.RFC3339Nano),
+		"level":     level.String(),
+		"subsystem": subsystem,
+		"msg":       msg,
+	}
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		if _, taken := entry[key]; taken {
+			key = "field." + key
+		}
+		var value interface{} = "(missing)"
+		if i+1 < len(fields) {
+			value = fieldValue(fields[i+1])
+		}
+		entry[key] = value
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		// something in there can't be encoded; fall back on printing it
+		for key, value := range entry {
+			entry[key] = fmt.Sprint(value)
+		}
+		b, _ = json.Marshal(entry)
+	}
+	return string(b) + "\n"
+}
@@ -0,0 +1,219 @@
+// Package metrics keeps counters, gauges and histograms, and writes them out
+// in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets suit things measured in seconds, from a quick search to a
+// slow download.
+var DefaultBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type family struct {
+	sync.Mutex
+
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+}
+
+var registry struct {
+	sync.Mutex
+	collectors []collector
+	hooks      []func()
+}
+
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+func register(c collector) {
+	registry.Lock()
+	registry.collectors = append(registry.collectors, c)
+	registry.Unlock()
+}
+
+// BeforeWrite has fn called every time the metrics are written out, so that
+// it can bring up to date anything which is cheaper to look up than to keep
+// track of.
+func BeforeWrite(fn func()) {
+	registry.Lock()
+	registry.hooks = append(registry.hooks, fn)
+	registry.Unlock()
+}
+
+// labelKey joins label values into something a map can be keyed by.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (f *family) labels(key string, extra ...string) string {
+	pairs := make([]string, 0, len(f.labelNames)+1)
+	if len(f.labelNames) != 0 {
+		for i, value := range strings.SplitN(key, "\xff", len(f.labelNames)) {
+			pairs = append(pairs, f.labelNames[i]+`="`+labelEscaper.Replace(value)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+extra[i+1]+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (f *family) header(w *bufio.Writer) {
+	w.WriteString("# HELP " + f.name + " " + f.help + "\n")
+	w.WriteString("# TYPE " + f.name + " " + f.kind + "\n")
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter only ever goes up. It's given a value for each of its label names
+// whenever it's changed.
+type Counter struct {
+	family
+	values map[string]float64
+}
+
+func NewCounter(name string, help string, labelNames ...string) *Counter {
+	c := &Counter{family{name: name, help: help, kind: "counter", labelNames: labelNames}, make(map[string]float64)}
+	register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.Lock()
+	c.values[labelKey(labelValues)] += v
+	c.Unlock()
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	c.header(w)
+	for _, key := range sortedKeys(c.values) {
+		w.WriteString(c.name + c.labels(key) + " " + formatValue(c.values[key]) + "\n")
+	}
+}
+
+// Gauge can go up and down.
+type Gauge struct {
+	Counter
+}
+
+func NewGauge(name string, help string, labelNames ...string) *Gauge {
+	g := &Gauge{Counter{family{name: name, help: help, kind: "gauge", labelNames: labelNames}, make(map[string]float64)}}
+	register(g)
+	return g
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.Lock()
+	g.values[labelKey(labelValues)] = v
+	g.Unlock()
+}
+
+// Reset forgets every value, for gauges whose label values come and go.
+func (g *Gauge) Reset() {
+	g.Lock()
+	g.values = make(map[string]float64)
+	g.Unlock()
+}
+
+// Histogram counts observations into buckets, which must be in increasing
+// order.
+type Histogram struct {
+	family
+	buckets []float64
+	counts  map[string][]uint64 // one for each bucket, and one more for +Inf
+	sums    map[string]float64
+}
+
+func NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	hist := &Histogram{
+		family:  family{name: name, help: help, kind: "histogram", labelNames: labelNames},
+		buckets: buckets,
+		counts:  make(map[string][]uint64),
+		sums:    make(map[string]float64),
+	}
+	register(hist)
+	return hist
+}
+
+func (hist *Histogram) Observe(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+
+	hist.Lock()
+	defer hist.Unlock()
+	counts, ok := hist.counts[key]
+	if !ok {
+		counts = make([]uint64, len(hist.buckets)+1)
+		hist.counts[key] = counts
+	}
+	i := sort.SearchFloat64s(hist.buckets, v) // the first bucket v fits in
+	counts[i]++
+	hist.sums[key] += v
+}
+
+func (hist *Histogram) write(w *bufio.Writer) {
+	hist.Lock()
+	defer hist.Unlock()
+	hist.header(w)
+	for _, key := range sortedKeys(hist.sums) {
+		cumulative := uint64(0)
+		for i, count := range hist.counts[key] {
+			cumulative += count
+			le := "+Inf"
+			if i < len(hist.buckets) {
+				le = formatValue(hist.buckets[i])
+			}
+			w.WriteString(hist.name + "_bucket" + hist.labels(key, "le", le) + " " + strconv.FormatUint(cumulative, 10) + "\n")
+		}
+		w.WriteString(hist.name + "_sum" + hist.labels(key) + " " + formatValue(hist.sums[key]) + "\n")
+		w.WriteString(hist.name + "_count" + hist.labels(key) + " " + strconv.FormatUint(cumulative, 10) + "\n")
+	}
+}
+
+// Write brings everything up to date and writes it all to w.
+func Write(w io.Writer) error {
+	registry.Lock()
+	hooks := registry.hooks
+	collectors := registry.collectors
+	registry.Unlock()
+
+	for _, fn := range hooks {
+		fn()
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func written(c collector) string {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	c.write(w)
+	w.Flush()
+	return buf.String()
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_requests_total", "Requests, by method and code.", "method", "code")
+	c.Inc("GET", "200")
+	c.Add(2, "POST", "500")
+	c.Inc("GET", "200")
+
+	want := `# HELP test_requests_total Requests, by method and code.
+# TYPE test_requests_total counter
+test_requests_total{method="GET",code="200"} 2
+test_requests_total{method="POST",code="500"} 2
+`
+	if got := written(c); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestGauge(t *testing.T) {
+	g := NewGauge("test_temperature", "How warm it is.")
+	g.Set(21.5)
+	g.Add(-1)
+
+	want := `# HELP test_temperature How warm it is.
+# TYPE test_temperature gauge
+test_temperature 20.5
+`
+	if got := written(g); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	g.Reset()
+	if got := written(g); strings.Contains(got, "\ntest_temperature ") {
+		t.Errorf("reset gauge still has a value:\n%s", got)
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	c := NewCounter("test_escaped_total", "Awkward label values.", "name")
+	c.Inc(`back\slash "quoted"` + "\nnewline")
+
+	want := `test_escaped_total{name="back\\slash \"quoted\"\nnewline"} 1`
+	if got := written(c); !strings.Contains(got, want+"\n") {
+		t.Errorf("got:\n%s\nwant a line:\n%s", got, want)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	hist := NewHistogram("test_seconds", "How long things took.", []float64{1, 2.5}, "zone")
+	for _, v := range []float64{0.5, 1, 2, 10} {
+		hist.Observe(v, "office")
+	}
+	hist.Observe(3, "kitchen")
+
+	// buckets count everything up to and including their bound
+	want := `# HELP test_seconds How long things took.
+# TYPE test_seconds histogram
+test_seconds_bucket{zone="kitchen",le="1"} 0
+test_seconds_bucket{zone="kitchen",le="2.5"} 0
+test_seconds_bucket{zone="kitchen",le="+Inf"} 1
+test_seconds_sum{zone="kitchen"} 3
+test_seconds_count{zone="kitchen"} 1
+test_seconds_bucket{zone="office",le="1"} 2
+test_seconds_bucket{zone="office",le="2.5"} 3
+test_seconds_bucket{zone="office",le="+Inf"} 4
+test_seconds_sum{zone="office"} 13.5
+test_seconds_count{zone="office"} 4
+`
+	if got := written(hist); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	g := NewGauge("test_hooked", "Brought up to date just before writing.")
+	BeforeWrite(func() { g.Set(42) })
+
+	var buf bytes.Buffer
+	if err := Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "\ntest_hooked 42\n") {
+		t.Errorf("hook's value wasn't written:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,53 @@
+package musebot
+
+import (
+	"strings"
+	"time"
+)
+
+// PlaylistItem refers to a song from a provider. The rest is only kept so the
+// playlist can be shown without asking the provider about every song.
+type PlaylistItem struct {
+	ProviderName string
+	ProviderId   string
+	Location     string // a local file, for songs which aren't from a provider
+
+	Title  string
+	Artist string
+	Album  string
+	Length int
+}
+
+type SavedPlaylist struct {
+	Name    string
+	Owner   string
+	Items   []PlaylistItem
+	Created time.Time
+	Updated time.Time
+}
+
+func PlaylistItemFromSongInfo(si SongInfo) PlaylistItem {
+	item := PlaylistItem{
+		ProviderId: si.ProviderId,
+		Title:      si.Title,
+		Artist:     si.Artist,
+		Album:      si.Album,
+		Length:     si.Length,
+	}
+	if si.Provider != nil {
+		item.ProviderName = si.Provider.PackageName()
+	} else {
+		item.ProviderName, _ = si.ProviderName.(string)
+	}
+	if item.ProviderName == "<<LOCAL>>" {
+		item.ProviderName = ""
+	}
+	item.Location = strings.TrimPrefix(si.MusicUrl, "file://")
+	return item
+}
+
+// HasProvider says whether item can be fetched from a provider, rather than
+// being a local file.
+func (item PlaylistItem) HasProvider() bool {
+	return len(item.ProviderName) != 0 && len(item.ProviderId) != 0
+}
@@ -0,0 +1,284 @@
+// Package playlistfile reads and writes playlists in the formats desktop
+// players understand (M3U8 and XSPF), as well as plain JSON.
+//
+// Songs from providers are written with a "musebot:<provider>:<id>" reference
+// so they survive the trip to another musebot, and local files by path.
+package playlistfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"musebot"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var ErrUnknownFormat = errors.New("Playlists can only be M3U8, XSPF or JSON.")
+
+const refScheme = "musebot:"
+
+// Formats maps each format's name to its Content-Type.
+var Formats = map[string]string{
+	"m3u8": "audio/x-mpegurl; charset=utf-8",
+	"xspf": "application/xspf+xml",
+	"json": "application/json",
+}
+
+// Normalise returns the canonical name of a format, or "" if it's not one of
+// ours.
+func Normalise(format string) string {
+	format = strings.TrimPrefix(strings.ToLower(format), ".")
+	if format == "m3u" {
+		format = "m3u8"
+	}
+	if _, ok := Formats[format]; !ok {
+		return ""
+	}
+	return format
+}
+
+// Sniff guesses the format of a playlist from what it starts with.
+func Sniff(b []byte) string {
+	b = bytes.TrimSpace(bytes.TrimPrefix(b, []byte("\xef\xbb\xbf")))
+	switch {
+	case len(b) == 0:
+		return "m3u8"
+	case b[0] == '<':
+		return "xspf"
+	case b[0] == '{' || b[0] == '[':
+		return "json"
+	}
+	return "m3u8"
+}
+
+func ref(item musebot.PlaylistItem) string {
+	return refScheme + item.ProviderName + ":" + item.ProviderId
+}
+
+// parseRef fills in item's provider from a musebot: reference, if s is one.
+func parseRef(s string, item *musebot.PlaylistItem) bool {
+	if !strings.HasPrefix(s, refScheme) {
+		return false
+	}
+	parts := strings.SplitN(s[len(refScheme):], ":", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return false
+	}
+	item.ProviderName, item.ProviderId = parts[0], parts[1]
+	return true
+}
+
+func fileUrl(path string) string {
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
+
+// parseLocation turns a file:// URL back into a path; anything else is
+// left alone.
+func parseLocation(s string) string {
+	if u, err := url.Parse(s); err == nil && u.Scheme == "file" {
+		return u.Path
+	}
+	return s
+}
+
+func displayName(item musebot.PlaylistItem) string {
+	if len(item.Artist) == 0 {
+		return item.Title
+	}
+	return item.Artist + " - " + item.Title
+}
+
+// splitDisplayName undoes displayName, as best it can.
+func splitDisplayName(display string) (string, string) {
+	display = strings.TrimSpace(display)
+	if dash := strings.Index(display, " - "); dash >= 0 {
+		return display[:dash], display[dash+3:]
+	}
+	return "", display
+}
+
+// Encode writes items out as a playlist in the given format.
+func Encode(format string, name string, items []musebot.PlaylistItem) ([]byte, error) {
+	switch Normalise(format) {
+	case "m3u8":
+		return encodeM3u(name, items), nil
+	case "xspf":
+		return encodeXspf(name, items)
+	case "json":
+		return json.MarshalIndent(jsonPlaylist{name, items}, "", "\t")
+	}
+	return nil, ErrUnknownFormat
+}
+
+// Decode reads a playlist in the given format, or whatever it looks like if
+// format is empty, returning its name (if it has one) and its songs.
+func Decode(format string, b []byte) (string, []musebot.PlaylistItem, error) {
+	if len(format) == 0 {
+		format = Sniff(b)
+	}
+	switch Normalise(format) {
+	case "m3u8":
+		return decodeM3u(b)
+	case "xspf":
+		return decodeXspf(b)
+	case "json":
+		return decodeJson(b)
+	}
+	return "", nil, ErrUnknownFormat
+}
+
+func encodeM3u(name string, items []musebot.PlaylistItem) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	if len(name) != 0 {
+		buf.WriteString("#PLAYLIST:" + name + "\n")
+	}
+	for _, item := range items {
+		length := item.Length
+		if length <= 0 {
+			length = -1
+		}
+		buf.WriteString("#EXTINF:" + strconv.Itoa(length) + "," + displayName(item) + "\n")
+		if len(item.Album) != 0 {
+			buf.WriteString("#EXTALB:" + item.Album + "\n")
+		}
+		switch {
+		case len(item.Location) != 0:
+			if item.HasProvider() {
+				buf.WriteString("#EXTID:" + ref(item) + "\n")
+			}
+			buf.WriteString(item.Location + "\n")
+		case item.HasProvider():
+			buf.WriteString(ref(item) + "\n")
+		}
+	}
+	return buf.Bytes()
+}
+
+func decodeM3u(b []byte) (string, []musebot.PlaylistItem, error) {
+	name := ""
+	items := make([]musebot.PlaylistItem, 0)
+	item := musebot.PlaylistItem{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case len(line) == 0:
+		case strings.HasPrefix(line, "#PLAYLIST:"):
+			name = strings.TrimSpace(line[len("#PLAYLIST:"):])
+		case strings.HasPrefix(line, "#EXTINF:"):
+			info := strings.SplitN(line[len("#EXTINF:"):], ",", 2)
+			if length, err := strconv.Atoi(strings.TrimSpace(info[0])); err == nil && length > 0 {
+				item.Length = length
+			}
+			if len(info) == 2 {
+				item.Artist, item.Title = splitDisplayName(info[1])
+			}
+		case strings.HasPrefix(line, "#EXTALB:"):
+			item.Album = strings.TrimSpace(line[len("#EXTALB:"):])
+		case strings.HasPrefix(line, "#EXTID:"):
+			parseRef(line[len("#EXTID:"):], &item)
+		case line[0] == '#':
+			// some other extension we don't care about
+		default:
+			if !parseRef(line, &item) {
+				item.Location = parseLocation(line)
+				if len(item.Title) == 0 {
+					base := filepath.Base(item.Location)
+					item.Artist, item.Title = splitDisplayName(strings.TrimSuffix(base, filepath.Ext(base)))
+				}
+			}
+			items = append(items, item)
+			item = musebot.PlaylistItem{}
+		}
+	}
+	return name, items, scanner.Err()
+}
+
+type xspfTrack struct {
+	Location   []string `xml:"location,omitempty"`
+	Identifier []string `xml:"identifier,omitempty"`
+	Title      string   `xml:"title,omitempty"`
+	Creator    string   `xml:"creator,omitempty"`
+	Album      string   `xml:"album,omitempty"`
+	Duration   int      `xml:"duration,omitempty"` // milliseconds
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version string      `xml:"version,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+func encodeXspf(name string, items []musebot.PlaylistItem) ([]byte, error) {
+	pl := xspfPlaylist{Version: "1", Title: name, Tracks: make([]xspfTrack, 0, len(items))}
+	for _, item := range items {
+		t := xspfTrack{Title: item.Title, Creator: item.Artist, Album: item.Album, Duration: item.Length * 1000}
+		if len(item.Location) != 0 {
+			t.Location = []string{fileUrl(item.Location)}
+		}
+		if item.HasProvider() {
+			t.Identifier = []string{ref(item)}
+		}
+		pl.Tracks = append(pl.Tracks, t)
+	}
+
+	b, err := xml.MarshalIndent(pl, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+func decodeXspf(b []byte) (string, []musebot.PlaylistItem, error) {
+	pl := xspfPlaylist{}
+	if err := xml.Unmarshal(b, &pl); err != nil {
+		return "", nil, err
+	}
+
+	items := make([]musebot.PlaylistItem, 0, len(pl.Tracks))
+	for _, t := range pl.Tracks {
+		item := musebot.PlaylistItem{Title: t.Title, Artist: t.Creator, Album: t.Album, Length: t.Duration / 1000}
+		for _, id := range t.Identifier {
+			if parseRef(id, &item) {
+				break
+			}
+		}
+		if len(t.Location) != 0 {
+			item.Location = parseLocation(t.Location[0])
+		}
+		items = append(items, item)
+	}
+	return pl.Title, items, nil
+}
+
+type jsonPlaylist struct {
+	Name  string
+	Items []musebot.PlaylistItem
+}
+
+// decodeJson takes either one of our exports or a bare list of songs.
+func decodeJson(b []byte) (string, []musebot.PlaylistItem, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) != 0 && b[0] == '[' {
+		items := make([]musebot.PlaylistItem, 0)
+		err := json.Unmarshal(b, &items)
+		return "", items, err
+	}
+
+	pl := jsonPlaylist{}
+	if err := json.Unmarshal(b, &pl); err != nil {
+		return "", nil, err
+	}
+	if pl.Items == nil {
+		pl.Items = make([]musebot.PlaylistItem, 0)
+	}
+	return pl.Name, pl.Items, nil
+}
@@ -0,0 +1,243 @@
+package playlists
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"musebot"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoSuchPlaylist = errors.New("You don't have a playlist with that name.")
+	ErrPlaylistExists = errors.New("You already have a playlist with that name.")
+	ErrBadName        = errors.New("Playlists need a name.")
+	ErrNoSuchItem     = errors.New("That playlist doesn't have that many songs.")
+)
+
+// Store keeps everyone's saved playlists, in memory and in a JSON file which
+// is rewritten whenever anything changes.
+type Store struct {
+	sync.Mutex
+	path      string
+	playlists map[string]map[string]*musebot.SavedPlaylist // owner, then name
+}
+
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, playlists: make(map[string]map[string]*musebot.SavedPlaylist)}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var saved []*musebot.SavedPlaylist
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return nil, err
+	}
+	for _, pl := range saved {
+		s.owned(pl.Owner)[pl.Name] = pl
+	}
+	return s, nil
+}
+
+func (s *Store) owned(owner string) map[string]*musebot.SavedPlaylist {
+	pls, ok := s.playlists[owner]
+	if !ok {
+		pls = make(map[string]*musebot.SavedPlaylist)
+		s.playlists[owner] = pls
+	}
+	return pls
+}
+
+// save writes everything out to a temporary file first, so a crash can't
+// leave us with half a file.
+func (s *Store) save() error {
+	all := make([]*musebot.SavedPlaylist, 0)
+	for _, pls := range s.playlists {
+		for _, pl := range pls {
+			all = append(all, pl)
+		}
+	}
+
+	b, err := json.MarshalIndent(all, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.path+".tmp", b, 0666); err != nil {
+		return err
+	}
+	return os.Rename(s.path+".tmp", s.path)
+}
+
+func copyOf(pl *musebot.SavedPlaylist) musebot.SavedPlaylist {
+	out := *pl
+	out.Items = append([]musebot.PlaylistItem{}, pl.Items...)
+	return out
+}
+
+type byName []musebot.SavedPlaylist
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+
+// List returns owner's playlists, sorted by name.
+func (s *Store) List(owner string) []musebot.SavedPlaylist {
+	s.Lock()
+	defer s.Unlock()
+
+	out := make([]musebot.SavedPlaylist, 0)
+	for _, pl := range s.playlists[owner] {
+		out = append(out, copyOf(pl))
+	}
+	sort.Sort(byName(out))
+	return out
+}
+
+func (s *Store) Get(owner string, name string) (musebot.SavedPlaylist, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	pl, ok := s.playlists[owner][name]
+	if !ok {
+		return musebot.SavedPlaylist{}, ErrNoSuchPlaylist
+	}
+	return copyOf(pl), nil
+}
+
+func (s *Store) Create(owner string, name string) (musebot.SavedPlaylist, error) {
+	name = strings.TrimSpace(name)
+	if len(name) == 0 {
+		return musebot.SavedPlaylist{}, ErrBadName
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.playlists[owner][name]; ok {
+		return musebot.SavedPlaylist{}, ErrPlaylistExists
+	}
+	now := time.Now()
+	pl := &musebot.SavedPlaylist{Name: name, Owner: owner, Items: make([]musebot.PlaylistItem, 0), Created: now, Updated: now}
+	s.owned(owner)[name] = pl
+	return copyOf(pl), s.save()
+}
+
+func (s *Store) Rename(owner string, name string, newName string) (musebot.SavedPlaylist, error) {
+	newName = strings.TrimSpace(newName)
+	if len(newName) == 0 {
+		return musebot.SavedPlaylist{}, ErrBadName
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	pl, ok := s.playlists[owner][name]
+	if !ok {
+		return musebot.SavedPlaylist{}, ErrNoSuchPlaylist
+	}
+	if _, ok := s.playlists[owner][newName]; ok && newName != name {
+		return musebot.SavedPlaylist{}, ErrPlaylistExists
+	}
+	delete(s.playlists[owner], name)
+	pl.Name = newName
+	pl.Updated = time.Now()
+	s.playlists[owner][newName] = pl
+	return copyOf(pl), s.save()
+}
+
+func (s *Store) Delete(owner string, name string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.playlists[owner][name]; !ok {
+		return ErrNoSuchPlaylist
+	}
+	delete(s.playlists[owner], name)
+	return s.save()
+}
+
+// Replace swaps out the songs on a playlist, creating it if need be.
+func (s *Store) Replace(owner string, name string, items []musebot.PlaylistItem) (musebot.SavedPlaylist, error) {
+	name = strings.TrimSpace(name)
+	if len(name) == 0 {
+		return musebot.SavedPlaylist{}, ErrBadName
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	pl, ok := s.playlists[owner][name]
+	if !ok {
+		pl = &musebot.SavedPlaylist{Name: name, Owner: owner, Created: now}
+		s.owned(owner)[name] = pl
+	}
+	pl.Items = append([]musebot.PlaylistItem{}, items...)
+	pl.Updated = now
+	return copyOf(pl), s.save()
+}
+
+// AddItem puts item at position on the playlist, or at the end if position
+// is negative or past the end.
+func (s *Store) AddItem(owner string, name string, item musebot.PlaylistItem, position int) (musebot.SavedPlaylist, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	pl, ok := s.playlists[owner][name]
+	if !ok {
+		return musebot.SavedPlaylist{}, ErrNoSuchPlaylist
+	}
+	if position < 0 || position > len(pl.Items) {
+		position = len(pl.Items)
+	}
+	pl.Items = append(pl.Items, musebot.PlaylistItem{})
+	copy(pl.Items[position+1:], pl.Items[position:])
+	pl.Items[position] = item
+	pl.Updated = time.Now()
+	return copyOf(pl), s.save()
+}
+
+func (s *Store) RemoveItem(owner string, name string, position int) (musebot.SavedPlaylist, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	pl, ok := s.playlists[owner][name]
+	if !ok {
+		return musebot.SavedPlaylist{}, ErrNoSuchPlaylist
+	}
+	if position < 0 || position >= len(pl.Items) {
+		return musebot.SavedPlaylist{}, ErrNoSuchItem
+	}
+	pl.Items = append(pl.Items[:position], pl.Items[position+1:]...)
+	pl.Updated = time.Now()
+	return copyOf(pl), s.save()
+}
+
+// MoveItem moves the song at from so it ends up at to.
+func (s *Store) MoveItem(owner string, name string, from int, to int) (musebot.SavedPlaylist, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	pl, ok := s.playlists[owner][name]
+	if !ok {
+		return musebot.SavedPlaylist{}, ErrNoSuchPlaylist
+	}
+	if from < 0 || from >= len(pl.Items) || to < 0 || to >= len(pl.Items) {
+		return musebot.SavedPlaylist{}, ErrNoSuchItem
+	}
+	item := pl.Items[from]
+	pl.Items = append(pl.Items[:from], pl.Items[from+1:]...)
+	pl.Items = append(pl.Items, musebot.PlaylistItem{})
+	copy(pl.Items[to+1:], pl.Items[to:])
+	pl.Items[to] = item
+	pl.Updated = time.Now()
+	return copyOf(pl), s.save()
+}
@@ -0,0 +1,136 @@
+// Package policy decides whether people are allowed to queue songs.
+package policy
+
+import (
+	"fmt"
+	"musebot"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Violation is the error returned when a song breaks one of the rules.
+type Violation struct {
+	Rule    string
+	Message string
+}
+
+func (v *Violation) Error() string {
+	return v.Message
+}
+
+type Engine struct {
+	sync.Mutex
+	cfg        musebot.QueuePolicyCfg
+	lastQueued map[string]time.Time
+}
+
+func New(cfg musebot.QueuePolicyCfg) *Engine {
+	return &Engine{cfg: cfg, lastQueued: make(map[string]time.Time)}
+}
+
+// RepeatWindow is how far back the history passed to Check needs to go.
+func (e *Engine) RepeatWindow() time.Duration {
+	return time.Duration(e.cfg.RepeatMinutes) * time.Minute
+}
+
+func normalise(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+// sameSong decides whether two songs are the same, either because they came
+// from the same place or because they have the same artist and title.
+func sameSong(aProvider, aId, aArtist, aTitle, bProvider, bId, bArtist, bTitle string) bool {
+	if len(aId) != 0 && aProvider == bProvider && aId == bId {
+		return true
+	}
+	return len(aTitle) != 0 && normalise(aArtist) == normalise(bArtist) && normalise(aTitle) == normalise(bTitle)
+}
+
+func providerName(si musebot.SongInfo) string {
+	if si.Provider != nil {
+		return si.Provider.PackageName()
+	}
+	name, _ := si.ProviderName.(string)
+	return name
+}
+
+func formatLength(secs int) string {
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
+}
+
+// Check sees whether user may queue si, given what's in the queue now and
+// what's been played within RepeatWindow.
+func (e *Engine) Check(si musebot.SongInfo, user string, queue []musebot.SongInfo, recent []musebot.HistoryEntry, now time.Time) error {
+	if e.cfg.MaxLength > 0 && si.Length > e.cfg.MaxLength {
+		return &Violation{"MaxLength", "That song's too long - the limit is " + formatLength(e.cfg.MaxLength) + "."}
+	}
+
+	name := providerName(si)
+	queued := 0
+	for _, q := range queue {
+		if q.QueueInfo != nil && q.QueueInfo.Culprit == user {
+			queued++
+		}
+		if e.cfg.RepeatMinutes > 0 && sameSong(name, si.ProviderId, si.Artist, si.Title, providerName(q), q.ProviderId, q.Artist, q.Title) {
+			return &Violation{"RepeatMinutes", "That song's already in the queue!"}
+		}
+	}
+	if e.cfg.MaxQueuedPerUser > 0 && queued >= e.cfg.MaxQueuedPerUser {
+		return &Violation{"MaxQueuedPerUser", fmt.Sprintf("You've already got %d songs in the queue - wait for some of them to play first!", queued)}
+	}
+
+	if e.cfg.RepeatMinutes > 0 {
+		for _, h := range recent {
+			if now.Sub(h.StartedAt) >= e.RepeatWindow() {
+				continue
+			}
+			if sameSong(name, si.ProviderId, si.Artist, si.Title, h.ProviderName, h.ProviderId, h.Artist, h.Title) {
+				ago := int(now.Sub(h.StartedAt).Minutes())
+				return &Violation{"RepeatMinutes", fmt.Sprintf("That song was played %d minutes ago - give it at least %d minutes.", ago, e.cfg.RepeatMinutes)}
+			}
+		}
+	}
+
+	return nil
+}
+
+// CheckCooldown sees whether user has waited long enough since they last
+// queued something.
+func (e *Engine) CheckCooldown(user string, now time.Time) error {
+	if e.cfg.CooldownSeconds <= 0 {
+		return nil
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	last, ok := e.lastQueued[user]
+	if !ok {
+		return nil
+	}
+	wait := last.Add(time.Duration(e.cfg.CooldownSeconds) * time.Second).Sub(now)
+	if wait > 0 {
+		return &Violation{"CooldownSeconds", fmt.Sprintf("Slow down! You can queue another song in %d seconds.", int(wait.Seconds()+0.999))}
+	}
+	return nil
+}
+
+// Queued starts user's cooldown.
+func (e *Engine) Queued(user string, now time.Time) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.lastQueued[user] = now
+}
+
+// Refund undoes the cooldown started at queuedAt, for a song which never got
+// queued, unless user's started another one since.
+func (e *Engine) Refund(user string, queuedAt time.Time) {
+	e.Lock()
+	defer e.Unlock()
+
+	if last, ok := e.lastQueued[user]; ok && last.Equal(queuedAt) {
+		delete(e.lastQueued, user)
+	}
+}
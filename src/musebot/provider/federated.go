@@ -0,0 +1,138 @@
+package provider
+
+import (
+	"errors"
+	"musebot"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrSearchTimedOut = errors.New("Provider took too long to answer")
+
+type federatedAnswer struct {
+	providerName string
+	results      musebot.SearchResults
+	complete     bool
+	err          error
+}
+
+type federatedResult struct {
+	song     musebot.FederatedSongInfo
+	bestRank int
+}
+
+// federatedRanking puts songs in the order the providers ranked them,
+// interleaved, with songs that more providers agree on winning ties.
+type federatedRanking []federatedResult
+
+func (fr federatedRanking) Len() int      { return len(fr) }
+func (fr federatedRanking) Swap(i, j int) { fr[i], fr[j] = fr[j], fr[i] }
+func (fr federatedRanking) Less(i, j int) bool {
+	if fr[i].bestRank != fr[j].bestRank {
+		return fr[i].bestRank < fr[j].bestRank
+	}
+	return len(fr[i].song.AvailableFrom) > len(fr[j].song.AvailableFrom)
+}
+
+func federatedKey(si musebot.SongInfo) string {
+	normalise := func(s string) string {
+		return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+	}
+	return normalise(si.Artist) + "\x00" + normalise(si.Title)
+}
+
+// FederatedSearch asks every provider the same query at once, giving each of
+// them up to timeout to answer. Results are merged on artist and title, noting
+// everywhere each song can be fetched from, then ranked and paged as a whole.
+// Providers which fail or time out are reported in the returned map instead of
+// failing the whole search. The total is -1 unless every provider gave us all
+// of its results. Each provider's search leaves out whatever hide says to.
+func FederatedSearch(providers musebot.Providers, q musebot.SearchQuery, timeout time.Duration, hide ResultFilter) ([]musebot.FederatedSongInfo, int, map[string]string) {
+	// everyone has to hand over enough to fill the page we've been asked for
+	perProvider := q
+	perProvider.Offset = 0
+	if q.Limit > 0 {
+		perProvider.Limit = q.Offset + q.Limit
+	}
+
+	answers := make(chan federatedAnswer, len(providers)) // buffered so stragglers never block
+	for name, p := range providers {
+		go func(name string, p musebot.Provider) {
+			res, err := Search(p, perProvider, hide)
+			complete := perProvider.Limit == 0 || len(res.Results) < perProvider.Limit || (res.Total >= 0 && res.Total <= len(res.Results))
+			answers <- federatedAnswer{name, res, complete, err}
+		}(name, p)
+	}
+
+	byProvider := make(map[string][]musebot.SongInfo)
+	failures := make(map[string]string)
+	allComplete := true
+	deadline := time.After(timeout)
+
+waiting:
+	for i := 0; i < len(providers); i++ {
+		select {
+		case a := <-answers:
+			if a.err != nil {
+				failures[a.providerName] = a.err.Error()
+				allComplete = false
+			} else {
+				byProvider[a.providerName] = a.results.Results
+				allComplete = allComplete && a.complete
+			}
+		case <-deadline:
+			break waiting
+		}
+	}
+
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+		if _, answered := byProvider[name]; !answered {
+			if _, failed := failures[name]; !failed {
+				failures[name] = ErrSearchTimedOut.Error()
+				allComplete = false
+			}
+		}
+	}
+	sort.Strings(names)
+
+	merged := make(federatedRanking, 0)
+	seen := make(map[string]int)
+	for _, name := range names {
+		for rank, si := range byProvider[name] {
+			key := federatedKey(si)
+			if i, ok := seen[key]; ok {
+				if _, already := merged[i].song.AvailableFrom[name]; !already {
+					merged[i].song.AvailableFrom[name] = si.ProviderId
+				}
+				if rank < merged[i].bestRank {
+					merged[i].bestRank = rank
+				}
+				continue
+			}
+			seen[key] = len(merged)
+			merged = append(merged, federatedResult{
+				song: musebot.FederatedSongInfo{
+					SongInfo:      si,
+					AvailableFrom: map[string]string{name: si.ProviderId},
+				},
+				bestRank: rank,
+			})
+		}
+	}
+	sort.Stable(merged)
+
+	total := -1
+	if allComplete {
+		total = len(merged)
+	}
+
+	results := make([]musebot.FederatedSongInfo, 0)
+	for i := q.Offset; i < len(merged) && (q.Limit <= 0 || i < q.Offset+q.Limit); i++ {
+		results = append(results, merged[i].song)
+	}
+
+	return results, total, failures
+}
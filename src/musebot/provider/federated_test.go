@@ -0,0 +1,64 @@
+package provider
+
+import (
+	"errors"
+	"musebot"
+	"testing"
+	"time"
+)
+
+// stubProvider answers every search with the same songs, or the same error,
+// after taking its time about it.
+type stubProvider struct {
+	name  string
+	songs []musebot.SongInfo
+	err   error
+	delay time.Duration
+}
+
+func (sp *stubProvider) Setup(map[string]string) error { return nil }
+func (sp *stubProvider) Name() string                  { return sp.name }
+func (sp *stubProvider) PackageName() string           { return sp.name }
+func (sp *stubProvider) SearchCapabilities() musebot.SearchCapabilities {
+	return musebot.SearchCapabilities{}
+}
+func (sp *stubProvider) UpdateSongInfo(*musebot.SongInfo) error                    { return nil }
+func (sp *stubProvider) FetchSong(*musebot.SongInfo, chan musebot.ProviderMessage) {}
+
+func (sp *stubProvider) Search(musebot.SearchQuery) (musebot.SearchResults, error) {
+	time.Sleep(sp.delay)
+	if sp.err != nil {
+		return musebot.SearchResults{}, sp.err
+	}
+	return musebot.SearchResults{sp.songs, len(sp.songs)}, nil
+}
+
+func TestFederatedSearchTotal(t *testing.T) {
+	songs := []musebot.SongInfo{
+		{Title: "One", Artist: "Someone", ProviderId: "1"},
+		{Title: "Two", Artist: "Someone", ProviderId: "2"},
+	}
+	working := &stubProvider{name: "working", songs: songs}
+
+	tests := []struct {
+		other     *stubProvider
+		wantTotal int
+	}{
+		{&stubProvider{name: "other", songs: songs}, 2},
+		{&stubProvider{name: "other", err: errors.New("catalog's on fire")}, -1},
+		{&stubProvider{name: "other", songs: songs, delay: time.Second}, -1},
+	}
+	for _, test := range tests {
+		providers := musebot.Providers{"working": working, "other": test.other}
+		results, total, failures := FederatedSearch(providers, musebot.SearchQuery{Text: "some", Limit: 10}, 100*time.Millisecond, nil)
+		if len(results) != 2 {
+			t.Errorf("got %d results, want 2", len(results))
+		}
+		if total != test.wantTotal {
+			t.Errorf("got a total of %d with failures %v, want %d", total, failures, test.wantTotal)
+		}
+		if _, failed := failures["other"]; failed != (test.wantTotal == -1) {
+			t.Errorf("other provider's failure was reported as %v", failures)
+		}
+	}
+}
@@ -9,10 +9,10 @@ import (
 	"errors"
 	"hash"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"musebot"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -53,7 +53,7 @@ type GroovesharkProvider struct {
 /* 
 	Setup(map[string]string) error
 
-	Search(string) ([]SongInfo, error)
+	Search(SearchQuery) (SearchResults, error)
 	UpdateSongInfo(*SongInfo) error
 	FetchSong(*SongInfo) (chan string, error)
 */
@@ -208,6 +208,12 @@ func (p *GroovesharkProvider) updateCommsToken() error {
 	return nil
 }
 
+// HealthCheck fetches a new communications token, which also keeps the one
+// we use fresh.
+func (p *GroovesharkProvider) HealthCheck() error {
+	return p.updateCommsToken()
+}
+
 func (p *GroovesharkProvider) String() string {
 	return "Grooveshark Provider by Luke Granger-Brown"
 }
@@ -270,7 +276,7 @@ func (p *GroovesharkProvider) Setup(cfg map[string]string) error {
 	gsFromPage := new(groovesharkConfigHtml5)
 	forceCfg, fcok := cfg["forceConfig"]
 	if !fcok {
-		log.Println("     - Fetching configuration from Grooveshark...")
+		providerLog.Info("Fetching configuration from Grooveshark...")
 		resp, err := p.fetchWebPage("http://html5.grooveshark.com")
 		if err != nil {
 			return err
@@ -286,7 +292,7 @@ func (p *GroovesharkProvider) Setup(cfg map[string]string) error {
 			return err
 		}
 	} else {
-		log.Println("     - Using configured Grooveshark configuration...")
+		providerLog.Info("Using configured Grooveshark configuration...")
 		err := json.Unmarshal([]byte(forceCfg), gsFromPage)
 		if err != nil {
 			return err
@@ -301,7 +307,7 @@ func (p *GroovesharkProvider) Setup(cfg map[string]string) error {
 	p.info.endpoint = "more.php"
 
 	// fetching comms token
-	log.Println("     - Fetching communications token from Grooveshark...")
+	providerLog.Info("Fetching communications token from Grooveshark...")
 	err := p.updateCommsToken()
 	if err != nil {
 		return err
@@ -330,14 +336,29 @@ func (p *GroovesharkProvider) groovesharkSongToMuseBotSong(r map[string]interfac
 	song.Provider = p
 	song.ProviderName = p.PackageName()
 	song.ProviderId = r["SongID"].(string)
+
+	// search results come with an estimate of how long the song is
+	switch duration := r["EstimateDuration"].(type) {
+	case string:
+		if d, err := strconv.ParseFloat(duration, 64); err == nil {
+			song.Length = int(d)
+		}
+	case float64:
+		song.Length = int(duration)
+	}
+}
+
+func (p *GroovesharkProvider) SearchCapabilities() musebot.SearchCapabilities {
+	// Grooveshark just hands back everything it found for a bit of text
+	return musebot.SearchCapabilities{}
 }
 
-func (p *GroovesharkProvider) Search(query string) ([]musebot.SongInfo, error) {
+func (p *GroovesharkProvider) Search(query musebot.SearchQuery) (musebot.SearchResults, error) {
 	// api call is "getResultsFromSearch"
-	parameters := map[string]string{"query": query, "type": "Songs", "guts": "1"}
+	parameters := map[string]string{"query": query.FlatText(), "type": "Songs", "guts": "1"}
 	result, err := p.apiCall("getResultsFromSearch", parameters)
 	if err != nil {
-		return make([]musebot.SongInfo, 0), err
+		return musebot.SearchResults{make([]musebot.SongInfo, 0), -1}, err
 	}
 
 	resultArrNotYet := ((((result.(map[string]interface{}))["result"]).(map[string]interface{}))["result"])
@@ -351,7 +372,7 @@ func (p *GroovesharkProvider) Search(query string) ([]musebot.SongInfo, error) {
 		finalResultArr[i] = *song
 	}
 
-	return finalResultArr, nil
+	return musebot.SearchResults{finalResultArr, len(finalResultArr)}, nil
 }
 
 func (p *GroovesharkProvider) UpdateSongInfo(song *musebot.SongInfo) error {
@@ -0,0 +1,320 @@
+package provider
+
+/*
+	HttpJsonProvider talks to any catalog service which speaks this contract.
+	All responses are JSON; paths are relative to the configured baseUrl.
+
+	GET /search?q=...&artist=...&album=...&title=...&min_length=...&max_length=...&offset=...&limit=...
+		{"total": 123, "songs": [<song>, ...]}
+
+		Only q is required. Which of the others the service honours is
+		declared in the provider's "supports" configuration (a comma separated
+		list of "paging", "fields", "length" and "total"); musebot takes care
+		of the rest itself. "total" may be left out of the response.
+
+	GET /songs/<id>
+		<song>
+
+	<song> is:
+		{
+			"id": "opaque string",
+			"title": "...", "artist": "...", "album": "...",
+			"length": 213,              // seconds, optional
+			"cover_art_url": "http://...", // optional
+			"stream_url": "/files/1.mp3",  // optional, may be relative to baseUrl
+			"format": "mp3"             // file extension, defaults to mp3
+		}
+
+	If a song has no stream_url, it is downloaded from GET /songs/<id>/stream.
+	Downloads should come with a Content-Length header, so progress can be
+	reported.
+
+	Configuration:
+		baseUrl        - where the service lives (required)
+		cacheDir       - where downloaded files are kept (required)
+		name           - what to call it in the UI (defaults to "HTTP Catalog")
+		authorization  - sent as the Authorization header on requests to baseUrl's host
+		supports       - see above
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"musebot"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type httpJsonSong struct {
+	Id          string `json:"id"`
+	Title       string `json:"title"`
+	Artist      string `json:"artist"`
+	Album       string `json:"album"`
+	Length      int    `json:"length"`
+	CoverArtUrl string `json:"cover_art_url"`
+	StreamUrl   string `json:"stream_url"`
+	Format      string `json:"format"`
+}
+
+type httpJsonSearchResults struct {
+	Total *int           `json:"total"`
+	Songs []httpJsonSong `json:"songs"`
+}
+
+type HttpJsonProvider struct {
+	baseUrl       *url.URL
+	cacheDir      string
+	name          string
+	authorization string
+	capabilities  musebot.SearchCapabilities
+	client        *http.Client
+}
+
+func (p *HttpJsonProvider) String() string {
+	return "Generic HTTP/JSON Catalog Provider"
+}
+
+func (p *HttpJsonProvider) Name() string {
+	return p.name
+}
+
+func (p *HttpJsonProvider) PackageName() string {
+	return "provider.HttpJsonProvider"
+}
+
+func (p *HttpJsonProvider) Setup(cfg map[string]string) error {
+	if cfg == nil {
+		return errors.New("HTTP/JSON Provider requires configuration!")
+	}
+
+	baseUrl, ok := cfg["baseUrl"]
+	if !ok {
+		return errors.New("HTTP/JSON Provider: baseUrl (where the catalog lives) must be provided!")
+	}
+	parsedUrl, err := url.Parse(strings.TrimRight(baseUrl, "/") + "/")
+	if err != nil {
+		return err
+	}
+	p.baseUrl = parsedUrl
+
+	p.cacheDir, ok = cfg["cacheDir"]
+	if !ok {
+		return errors.New("HTTP/JSON Provider: cacheDir (the directory where I store files) must be provided!")
+	}
+
+	p.name, ok = cfg["name"]
+	if !ok {
+		p.name = "HTTP Catalog"
+	}
+	p.authorization = cfg["authorization"]
+
+	p.capabilities = musebot.SearchCapabilities{}
+	for _, feature := range strings.Split(cfg["supports"], ",") {
+		switch strings.TrimSpace(feature) {
+		case "paging":
+			p.capabilities.Paging = true
+		case "fields":
+			p.capabilities.FieldScoped = true
+		case "length":
+			p.capabilities.LengthFilter = true
+		case "total":
+			p.capabilities.Total = true
+		case "":
+		default:
+			return errors.New("HTTP/JSON Provider: don't know how to support '" + feature + "'")
+		}
+	}
+
+	p.client = &http.Client{}
+
+	return nil
+}
+
+// HealthCheck makes sure the catalog's answering. What's at baseUrl itself is
+// up to the catalog, so only server errors count against it.
+func (p *HttpJsonProvider) HealthCheck() error {
+	req, err := p.newRequest("")
+	if err != nil {
+		return err
+	}
+	req.Method = "HEAD"
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%s: catalog returned %s", p.name, resp.Status)
+	}
+	return nil
+}
+
+func (p *HttpJsonProvider) newRequest(path string) (*http.Request, error) {
+	target, err := p.baseUrl.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// stream URLs can point anywhere, and our credential is only for the catalog
+	if len(p.authorization) != 0 && target.Scheme == p.baseUrl.Scheme && strings.EqualFold(target.Host, p.baseUrl.Host) {
+		req.Header.Set("Authorization", p.authorization)
+	}
+	return req, nil
+}
+
+func (p *HttpJsonProvider) getJson(path string, into interface{}) error {
+	req, err := p.newRequest(path)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return errors.New("That song no longer exists!")
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: catalog returned %s", p.name, resp.Status)
+	}
+
+	return json.Unmarshal(body, into)
+}
+
+func (p *HttpJsonProvider) songPath(id string) string {
+	return "songs/" + url.PathEscape(id)
+}
+
+func (p *HttpJsonProvider) httpJsonSongToMuseBotSong(s httpJsonSong, song *musebot.SongInfo) {
+	song.Title = s.Title
+	song.Artist = s.Artist
+	song.Album = s.Album
+	song.Length = s.Length
+	song.CoverArtUrl = s.CoverArtUrl
+	song.Provider = p
+	song.ProviderName = p.PackageName()
+	song.ProviderId = s.Id
+}
+
+func (p *HttpJsonProvider) SearchCapabilities() musebot.SearchCapabilities {
+	return p.capabilities
+}
+
+func (p *HttpJsonProvider) Search(query musebot.SearchQuery) (musebot.SearchResults, error) {
+	params := url.Values{}
+	params.Set("q", query.Text)
+	if len(query.Artist) != 0 {
+		params.Set("artist", query.Artist)
+	}
+	if len(query.Album) != 0 {
+		params.Set("album", query.Album)
+	}
+	if len(query.Title) != 0 {
+		params.Set("title", query.Title)
+	}
+	if query.MinLength > 0 {
+		params.Set("min_length", strconv.Itoa(query.MinLength))
+	}
+	if query.MaxLength > 0 {
+		params.Set("max_length", strconv.Itoa(query.MaxLength))
+	}
+	if query.Offset > 0 {
+		params.Set("offset", strconv.Itoa(query.Offset))
+	}
+	if query.Limit > 0 {
+		params.Set("limit", strconv.Itoa(query.Limit))
+	}
+
+	res := httpJsonSearchResults{}
+	err := p.getJson("search?"+params.Encode(), &res)
+	if err != nil {
+		return musebot.SearchResults{make([]musebot.SongInfo, 0), -1}, err
+	}
+
+	results := make([]musebot.SongInfo, len(res.Songs))
+	for i, s := range res.Songs {
+		p.httpJsonSongToMuseBotSong(s, &results[i])
+	}
+
+	total := -1
+	if res.Total != nil {
+		total = *res.Total
+	}
+
+	return musebot.SearchResults{results, total}, nil
+}
+
+func (p *HttpJsonProvider) UpdateSongInfo(song *musebot.SongInfo) error {
+	if song.ProviderName != p.PackageName() {
+		return errors.New("Song was not from this provider!")
+	}
+
+	s := httpJsonSong{}
+	err := p.getJson(p.songPath(song.ProviderId), &s)
+	if err != nil {
+		return err
+	}
+
+	p.httpJsonSongToMuseBotSong(s, song)
+	return nil
+}
+
+func (p *HttpJsonProvider) FetchSong(song *musebot.SongInfo, comms chan musebot.ProviderMessage) {
+	if song.ProviderName != p.PackageName() {
+		comms <- musebot.ProviderMessage{"error", errors.New("Song was not from this provider!")}
+		return
+	}
+
+	// we need the stream URL and format, which aren't kept in the SongInfo
+	s := httpJsonSong{}
+	err := p.getJson(p.songPath(song.ProviderId), &s)
+	if err != nil {
+		comms <- musebot.ProviderMessage{"error", err}
+		return
+	}
+	if len(s.StreamUrl) == 0 {
+		s.StreamUrl = p.songPath(song.ProviderId) + "/stream"
+	}
+
+	// neither ids nor formats can be trusted anywhere near the filesystem
+	downloadLocation := p.cacheDir + "/" + hexSha1(s.Id) + "." + fileExtension(s.Format)
+
+	if c, _ := doesFileExist(downloadLocation); !c {
+		comms <- musebot.ProviderMessage{"stages", 1}
+		comms <- musebot.ProviderMessage{"current_stage", 1}
+		comms <- musebot.ProviderMessage{"current_stage_description", "Downloading file..."}
+
+		req, err := p.newRequest(s.StreamUrl)
+		if err != nil {
+			comms <- musebot.ProviderMessage{"error", err}
+			return
+		}
+
+		_, err = downloadRequestAndReportProgress(p.client, req, downloadLocation, comms)
+		if err != nil {
+			comms <- musebot.ProviderMessage{"error", err}
+			return
+		}
+	} else {
+		comms <- musebot.ProviderMessage{"stages", 0}
+	}
+
+	song.MusicUrl = downloadLocation
+
+	comms <- musebot.ProviderMessage{"done", nil}
+}
@@ -0,0 +1,187 @@
+package provider
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"musebot"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeCatalog stands in for a catalog service speaking the HTTP/JSON
+// contract, with a couple of songs on it.
+func fakeCatalog() *httptest.Server {
+	songs := map[string]httpJsonSong{
+		"1":     {Id: "1", Title: "One", Artist: "Someone", Length: 180, StreamUrl: "/files/1", Format: "flac"},
+		"a b/c": {Id: "a b/c", Title: "Awkward", Artist: "Someone Else"},
+		"evil":  {Id: "evil", Title: "Evil", Format: "../../../tmp/evil"},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+		}
+	})
+	mux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sekrit" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		total := 2
+		res := httpJsonSearchResults{Total: &total, Songs: []httpJsonSong{songs["1"], songs["a b/c"]}}
+		if r.URL.Query().Get("q") != "some" {
+			res = httpJsonSearchResults{}
+		}
+		json.NewEncoder(w).Encode(res)
+	})
+	mux.HandleFunc("/songs/", func(w http.ResponseWriter, r *http.Request) {
+		escaped := strings.TrimPrefix(r.URL.EscapedPath(), "/songs/")
+		if strings.HasSuffix(escaped, "/stream") {
+			w.Header().Set("Content-Length", "6")
+			w.Write([]byte("stream"))
+			return
+		}
+		// ids have to arrive as a single path segment
+		id, ok := map[string]string{"1": "1", "a%20b%2Fc": "a b/c", "evil": "evil"}[escaped]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(songs[id])
+	})
+	mux.HandleFunc("/files/1", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		w.Write([]byte("music"))
+	})
+	return httptest.NewServer(mux)
+}
+
+func newTestHttpJsonProvider(t *testing.T, baseUrl string) *HttpJsonProvider {
+	p := new(HttpJsonProvider)
+	err := p.Setup(map[string]string{
+		"baseUrl":       baseUrl,
+		"cacheDir":      t.TempDir(),
+		"authorization": "Bearer sekrit",
+		"supports":      "paging,total",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestHttpJsonSearch(t *testing.T) {
+	srv := fakeCatalog()
+	defer srv.Close()
+	p := newTestHttpJsonProvider(t, srv.URL)
+
+	res, err := p.Search(musebot.SearchQuery{Text: "some", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Total != 2 || len(res.Results) != 2 {
+		t.Fatalf("got %d results out of %d, want 2 out of 2", len(res.Results), res.Total)
+	}
+	si := res.Results[0]
+	if si.Title != "One" || si.Artist != "Someone" || si.Length != 180 || si.ProviderId != "1" || si.ProviderName != p.PackageName() {
+		t.Errorf("first result is %+v", si)
+	}
+}
+
+func TestHttpJsonUpdateSongInfo(t *testing.T) {
+	srv := fakeCatalog()
+	defer srv.Close()
+	p := newTestHttpJsonProvider(t, srv.URL)
+
+	si := musebot.SongInfo{ProviderName: p.PackageName(), ProviderId: "a b/c"}
+	if err := p.UpdateSongInfo(&si); err != nil {
+		t.Fatal(err)
+	}
+	if si.Title != "Awkward" {
+		t.Errorf("got title %q, want %q", si.Title, "Awkward")
+	}
+
+	si = musebot.SongInfo{ProviderName: p.PackageName(), ProviderId: "missing"}
+	if err := p.UpdateSongInfo(&si); err == nil {
+		t.Error("updating a song the catalog doesn't have should fail")
+	}
+}
+
+func TestHttpJsonFetchSong(t *testing.T) {
+	srv := fakeCatalog()
+	defer srv.Close()
+	p := newTestHttpJsonProvider(t, srv.URL)
+
+	tests := []struct {
+		id, ext, content string
+	}{
+		{"1", ".flac", "music"},
+		{"a b/c", ".mp3", "stream"}, // no stream_url or format
+		{"evil", ".mp3", "stream"},  // a format which would escape the cache
+	}
+	for _, test := range tests {
+		si := musebot.SongInfo{ProviderName: p.PackageName(), ProviderId: test.id}
+		m := lastMessage(fetchAll(p, &si))
+		if m.Type != "done" {
+			t.Errorf("fetching %q: %v", test.id, m.Content)
+			continue
+		}
+		if filepath.Dir(si.MusicUrl) != p.cacheDir || filepath.Ext(si.MusicUrl) != test.ext {
+			t.Errorf("fetching %q: got %q, want a %s file in %s", test.id, si.MusicUrl, test.ext, p.cacheDir)
+			continue
+		}
+		b, err := ioutil.ReadFile(si.MusicUrl)
+		if err != nil || string(b) != test.content {
+			t.Errorf("fetching %q: got %q (%v), want %q", test.id, b, err, test.content)
+		}
+	}
+}
+
+func TestHttpJsonHealthCheck(t *testing.T) {
+	srv := fakeCatalog()
+	p := newTestHttpJsonProvider(t, srv.URL)
+	if err := p.HealthCheck(); err != nil {
+		t.Errorf("healthy catalog failed its health check: %v", err)
+	}
+
+	srv.Close()
+	if err := p.HealthCheck(); err == nil {
+		t.Error("catalog which has gone away passed its health check")
+	}
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+	p = newTestHttpJsonProvider(t, broken.URL)
+	if err := p.HealthCheck(); err == nil {
+		t.Error("catalog returning 503 passed its health check")
+	}
+}
+
+func TestHttpJsonStreamElsewhereGetsNoCredential(t *testing.T) {
+	var authorization string
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte("music"))
+	}))
+	defer elsewhere.Close()
+
+	catalog := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(httpJsonSong{Id: "far", StreamUrl: elsewhere.URL + "/far.mp3"})
+	}))
+	defer catalog.Close()
+	p := newTestHttpJsonProvider(t, catalog.URL)
+
+	si := musebot.SongInfo{ProviderName: p.PackageName(), ProviderId: "far"}
+	if m := lastMessage(fetchAll(p, &si)); m.Type != "done" {
+		t.Fatalf("fetching from another host: %v", m.Content)
+	}
+	if len(authorization) != 0 {
+		t.Errorf("another host was sent our credential %q", authorization)
+	}
+}
@@ -0,0 +1,49 @@
+package provider
+
+import (
+	"musebot"
+	"musebot/logging"
+	"musebot/metrics"
+	"time"
+)
+
+var (
+	searchSeconds = metrics.NewHistogram("musebot_provider_search_seconds", "How long providers take to answer searches.", metrics.DefaultBuckets, "provider")
+	searchErrors  = metrics.NewCounter("musebot_provider_search_errors_total", "Searches which providers couldn't answer.", "provider")
+	fetchSeconds  = metrics.NewHistogram("musebot_provider_fetch_seconds", "How long providers take to fetch songs, successfully or not.", metrics.DefaultBuckets, "provider")
+	fetchErrors   = metrics.NewCounter("musebot_provider_fetch_errors_total", "Songs which providers couldn't fetch.", "provider")
+	downloadBytes = metrics.NewCounter("musebot_download_bytes_total", "Bytes of music downloaded by providers.")
+)
+
+var providerLog = logging.New("provider")
+
+// Fetch has si's provider fetch it, passing everything it says on to comms
+// while keeping count of how it went. fields say what it's being fetched for,
+// like the request or job.
+func Fetch(fields []interface{}, si *musebot.SongInfo, comms chan musebot.ProviderMessage) {
+	p := si.Provider
+	name := p.PackageName()
+	log := providerLog.With(fields...).With("provider", name, "provider_id", si.ProviderId)
+	log.Debug("Fetching", "title", si.Title)
+	started := time.Now()
+
+	relay := make(chan musebot.ProviderMessage)
+	go p.FetchSong(si, relay)
+	for {
+		m := <-relay
+		if m.Type == "done" || m.Type == "error" {
+			took := time.Since(started).Seconds()
+			fetchSeconds.Observe(took, name)
+			if m.Type == "error" {
+				fetchErrors.Inc(name)
+				log.Warn("Couldn't fetch", "title", si.Title, "seconds", took, "error", m.Content)
+			} else {
+				log.Info("Fetched", "title", si.Title, "seconds", took)
+			}
+		}
+		comms <- m
+		if m.Type == "done" || m.Type == "error" {
+			return
+		}
+	}
+}
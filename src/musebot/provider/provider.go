@@ -2,10 +2,14 @@ package provider
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"io/ioutil"
 	"musebot"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
 	"strconv"
 )
 
@@ -14,20 +18,39 @@ type Provider musebot.Provider
 //type Providers musebot.Providers
 
 func Providers() []Provider {
-	return []Provider{new(GroovesharkProvider)}
+	return []Provider{new(GroovesharkProvider), new(HttpJsonProvider), new(SubsonicProvider)}
 }
 
 func downloadFileAndReportProgress(finalUrl string, location string, comms chan musebot.ProviderMessage) (string, error) {
-	resp, err := http.Get(finalUrl)
+	req, err := http.NewRequest("GET", finalUrl, nil)
 	if err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
+	return downloadRequestAndReportProgress(http.DefaultClient, req, location, comms)
+}
 
-	fullLength, err := strconv.ParseUint(resp.Header.Get("Content-Length"), 10, 64) // this REQUIRES a content-length header
-	if err != nil {
+func downloadRequestAndReportProgress(client *http.Client, req *http.Request, location string, comms chan musebot.ProviderMessage) (string, error) {
+	resp, err := client.Do(req)
+	if ue, ok := err.(*url.Error); ok {
+		// download URLs can have credentials in them, and this goes to clients
+		return "", errors.New("Download failed: " + ue.Err.Error())
+	} else if err != nil {
 		return "", err
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("Download failed: " + resp.Status)
+	}
+
+	// transcoded streams don't know how long they'll be; report those as 0
+	fullLength := uint64(0)
+	if contentLength := resp.Header.Get("Content-Length"); len(contentLength) != 0 {
+		fullLength, err = strconv.ParseUint(contentLength, 10, 64)
+		if err != nil {
+			return "", err
+		}
+	}
 	comms <- musebot.ProviderMessage{"length", fullLength}
 	finalOutput := new(bytes.Buffer)
 	bytesDownloaded := 0
@@ -35,19 +58,23 @@ func downloadFileAndReportProgress(finalUrl string, location string, comms chan
 	for {
 		buffer := make([]byte, 4096)
 		n, err := resp.Body.Read(buffer)
-		if err != nil && err.Error() == "EOF" {
+		// a reader may hand back the last few bytes along with EOF
+		if n > 0 {
+			bytesDownloaded += n
+			downloadBytes.Add(float64(n))
+			comms <- musebot.ProviderMessage{"downloaded", bytesDownloaded}
+			finalOutput.Write(buffer[:n])
+		}
+		if err == io.EOF {
 			break
 		} else if err != nil {
 			return "", err
 		}
-		bytesDownloaded += n
-		comms <- musebot.ProviderMessage{"downloaded", bytesDownloaded}
-		finalOutput.Write(buffer[:n])
 	}
 	// write to disk!
-	ioutil.WriteFile(location, finalOutput.Bytes(), os.FileMode(0666))
+	err = ioutil.WriteFile(location, finalOutput.Bytes(), os.FileMode(0666))
 
-	return "", nil
+	return "", err
 }
 
 func doesFileExist(path string) (bool, error) {
@@ -61,3 +88,14 @@ func doesFileExist(path string) (bool, error) {
 	}
 	return true, nil
 }
+
+var safeExtension = regexp.MustCompile(`^[a-z0-9]{1,5}$`)
+
+// fileExtension is ext if it's safe to put on the end of a file name, which
+// anything a remote server hands us might not be, or mp3 otherwise.
+func fileExtension(ext string) string {
+	if !safeExtension.MatchString(ext) {
+		return "mp3"
+	}
+	return ext
+}
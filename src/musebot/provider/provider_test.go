@@ -0,0 +1,47 @@
+package provider
+
+import (
+	"musebot"
+	"testing"
+)
+
+// fetchAll has p fetch si, and collects everything it says until it's done.
+func fetchAll(p musebot.Provider, si *musebot.SongInfo) []musebot.ProviderMessage {
+	comms := make(chan musebot.ProviderMessage)
+	go p.FetchSong(si, comms)
+
+	messages := make([]musebot.ProviderMessage, 0)
+	for {
+		m := <-comms
+		messages = append(messages, m)
+		if m.Type == "done" || m.Type == "error" {
+			return messages
+		}
+	}
+}
+
+func lastMessage(messages []musebot.ProviderMessage) musebot.ProviderMessage {
+	return messages[len(messages)-1]
+}
+
+func TestFileExtension(t *testing.T) {
+	tests := map[string]string{
+		"mp3":      "mp3",
+		"flac":     "flac",
+		"m4a":      "m4a",
+		"":         "mp3",
+		"../../x":  "mp3",
+		"a/b":      "mp3",
+		"MP3":      "mp3",
+		"toolong":  "mp3",
+		"ogg\x00":  "mp3",
+		"opus":     "opus",
+		".mp3":     "mp3",
+		"mp3 flac": "mp3",
+	}
+	for ext, want := range tests {
+		if got := fileExtension(ext); got != want {
+			t.Errorf("fileExtension(%q) = %q, want %q", ext, got, want)
+		}
+	}
+}
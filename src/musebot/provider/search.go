@@ -0,0 +1,94 @@
+package provider
+
+import (
+	"musebot"
+	"strings"
+	"time"
+)
+
+func containsFold(haystack string, needle string) bool {
+	return strings.Contains(strings.ToLower(haystack), strings.ToLower(needle))
+}
+
+func matchesQuery(si musebot.SongInfo, q musebot.SearchQuery, fields bool, length bool) bool {
+	if fields {
+		if !containsFold(si.Artist, q.Artist) || !containsFold(si.Album, q.Album) || !containsFold(si.Title, q.Title) {
+			return false
+		}
+	}
+	// songs whose length we don't know are given the benefit of the doubt
+	if length && si.Length > 0 {
+		if q.MinLength > 0 && si.Length < q.MinLength {
+			return false
+		}
+		if q.MaxLength > 0 && si.Length > q.MaxLength {
+			return false
+		}
+	}
+	return true
+}
+
+func pageResults(results []musebot.SongInfo, offset int, limit int) []musebot.SongInfo {
+	if offset >= len(results) {
+		return make([]musebot.SongInfo, 0)
+	}
+	results = results[offset:]
+	if limit > 0 && limit < len(results) {
+		results = results[:limit]
+	}
+	return results
+}
+
+// ResultFilter says whether a search result should be left out. It may change
+// the results it lets through.
+type ResultFilter func(*musebot.SongInfo) bool
+
+// Search runs q against p, doing whatever p doesn't declare in its
+// SearchCapabilities on top of the results it hands back. Results hide says
+// to leave out (if it isn't nil) are left out before paging, so they don't
+// count towards the total or leave pages short.
+func Search(p musebot.Provider, q musebot.SearchQuery, hide ResultFilter) (musebot.SearchResults, error) {
+	caps := p.SearchCapabilities()
+
+	filterFields := q.HasFields() && !caps.FieldScoped
+	filterLength := q.HasLengthFilter() && !caps.LengthFilter
+	// if we're throwing results away ourselves, the provider's paging would
+	// have been applied to the wrong list
+	pageLocally := !caps.Paging || filterFields || filterLength || hide != nil
+
+	providerQuery := q
+	if filterFields {
+		providerQuery.Text = q.FlatText()
+		providerQuery.Artist, providerQuery.Album, providerQuery.Title = "", "", ""
+	}
+	if filterLength {
+		providerQuery.MinLength, providerQuery.MaxLength = 0, 0
+	}
+	if pageLocally {
+		providerQuery.Offset, providerQuery.Limit = 0, 0
+	}
+
+	started := time.Now()
+	res, err := p.Search(providerQuery)
+	searchSeconds.Observe(time.Since(started).Seconds(), p.PackageName())
+	if err != nil {
+		searchErrors.Inc(p.PackageName())
+		return musebot.SearchResults{make([]musebot.SongInfo, 0), -1}, err
+	}
+
+	if !pageLocally {
+		if !caps.Total {
+			res.Total = -1
+		}
+		return res, nil
+	}
+
+	filtered := make([]musebot.SongInfo, 0, len(res.Results))
+	for _, si := range res.Results {
+		if matchesQuery(si, q, filterFields, filterLength) && (hide == nil || !hide(&si)) {
+			filtered = append(filtered, si)
+		}
+	}
+
+	return musebot.SearchResults{pageResults(filtered, q.Offset, q.Limit), len(filtered)}, nil
+}
@@ -0,0 +1,318 @@
+package provider
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"musebot"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type subsonicError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type subsonicSong struct {
+	Id       string `json:"id"`
+	Title    string `json:"title"`
+	Artist   string `json:"artist"`
+	Album    string `json:"album"`
+	Duration int    `json:"duration"`
+	CoverArt string `json:"coverArt"`
+	Suffix   string `json:"suffix"`
+}
+
+type subsonicResponse struct {
+	Status        string         `json:"status"`
+	Error         *subsonicError `json:"error"`
+	Song          *subsonicSong  `json:"song"`
+	SearchResult3 *struct {
+		Song []subsonicSong `json:"song"`
+	} `json:"searchResult3"`
+}
+
+type subsonicEnvelope struct {
+	Response subsonicResponse `json:"subsonic-response"`
+}
+
+type SubsonicProvider struct {
+	baseUrl      string
+	username     string
+	password     string
+	clientName   string
+	apiVersion   string
+	cacheDir     string
+	stream       bool
+	streamFormat string
+	client       *http.Client
+}
+
+func (p *SubsonicProvider) String() string {
+	return "Subsonic/OpenSubsonic Provider"
+}
+
+func (p *SubsonicProvider) Name() string {
+	return "Subsonic"
+}
+
+func (p *SubsonicProvider) PackageName() string {
+	return "provider.SubsonicProvider"
+}
+
+func (p *SubsonicProvider) Setup(cfg map[string]string) error {
+	if cfg == nil {
+		return errors.New("Subsonic Provider requires configuration!")
+	}
+
+	var ok bool
+	p.baseUrl, ok = cfg["baseUrl"]
+	if !ok {
+		return errors.New("Subsonic Provider: baseUrl (where the server lives) must be provided!")
+	}
+	p.baseUrl = strings.TrimRight(p.baseUrl, "/")
+
+	var uok, pok bool
+	p.username, uok = cfg["username"]
+	p.password, pok = cfg["password"]
+	if !uok || !pok {
+		return errors.New("Subsonic Provider: username/password were missing from configuration.")
+	}
+
+	p.cacheDir, ok = cfg["cacheDir"]
+	if !ok {
+		return errors.New("Subsonic Provider: cacheDir (the directory where I store files) must be provided!")
+	}
+
+	p.clientName, ok = cfg["clientName"]
+	if !ok {
+		p.clientName = "musebot"
+	}
+	p.apiVersion, ok = cfg["apiVersion"]
+	if !ok {
+		p.apiVersion = "1.16.1"
+	}
+
+	// "download" hands over the original file, "stream" lets the server transcode
+	switch cfg["fetchMethod"] {
+	case "", "download":
+		p.stream = false
+	case "stream":
+		p.stream = true
+		p.streamFormat, ok = cfg["streamFormat"]
+		if !ok {
+			p.streamFormat = "mp3"
+		}
+	default:
+		return errors.New("Subsonic Provider: fetchMethod must be either 'download' or 'stream'.")
+	}
+
+	p.client = &http.Client{}
+
+	// make sure the credentials are any good
+	return p.HealthCheck()
+}
+
+func (p *SubsonicProvider) HealthCheck() error {
+	_, err := p.apiCall("ping", url.Values{})
+	return err
+}
+
+func (p *SubsonicProvider) generateSalt() string {
+	salt := make([]byte, 8)
+	rand.Read(salt)
+	return hex.EncodeToString(salt)
+}
+
+// methodUrl builds the URL for a REST method, including a freshly salted
+// authentication token.
+func (p *SubsonicProvider) methodUrl(method string, params url.Values) string {
+	salt := p.generateSalt()
+	params.Set("u", p.username)
+	params.Set("t", hexMd5(p.password+salt))
+	params.Set("s", salt)
+	params.Set("v", p.apiVersion)
+	params.Set("c", p.clientName)
+	return p.baseUrl + "/rest/" + method + "?" + params.Encode()
+}
+
+// get calls a REST method. Errors leave out the URL, which has our
+// credentials in it.
+func (p *SubsonicProvider) get(method string, params url.Values) (*http.Response, error) {
+	resp, err := p.client.Get(p.methodUrl(method, params))
+	if ue, ok := err.(*url.Error); ok {
+		err = errors.New("Subsonic: couldn't call " + method + ": " + ue.Err.Error())
+	}
+	return resp, err
+}
+
+func (p *SubsonicProvider) apiCall(method string, params url.Values) (*subsonicResponse, error) {
+	params.Set("f", "json")
+	resp, err := p.get(method, params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := subsonicEnvelope{}
+	err = json.Unmarshal(body, &envelope)
+	if err != nil {
+		return nil, errors.New("Subsonic: couldn't understand response to " + method + ": " + resp.Status)
+	}
+
+	if envelope.Response.Status != "ok" {
+		if envelope.Response.Error != nil {
+			return nil, errors.New("Error in Subsonic call " + method + ": " + envelope.Response.Error.Message)
+		}
+		return nil, errors.New("Error in Subsonic call " + method)
+	}
+
+	return &envelope.Response, nil
+}
+
+func (p *SubsonicProvider) subsonicSongToMuseBotSong(s subsonicSong, song *musebot.SongInfo) {
+	song.Title = s.Title
+	song.Artist = s.Artist
+	song.Album = s.Album
+	song.Length = s.Duration
+	song.CoverArtUrl = ""
+	if len(s.CoverArt) != 0 {
+		// getCoverArt needs our credentials, so musebot fetches it on the
+		// client's behalf
+		song.CoverArtUrl = musebot.CoverArtProxyUrl(p.PackageName(), s.CoverArt)
+	}
+	song.Provider = p
+	song.ProviderName = p.PackageName()
+	song.ProviderId = s.Id
+}
+
+func (p *SubsonicProvider) FetchCoverArt(id string) (io.ReadCloser, string, error) {
+	resp, err := p.get("getCoverArt", url.Values{"id": {id}, "size": {"500"}})
+	if err != nil {
+		return nil, "", err
+	}
+	// errors come back as a subsonic-response, not an image
+	contentType := resp.Header.Get("Content-Type")
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(contentType, "image/") {
+		resp.Body.Close()
+		return nil, "", errors.New("Subsonic: couldn't fetch cover art " + id + ": " + resp.Status)
+	}
+	return resp.Body, contentType, nil
+}
+
+func (p *SubsonicProvider) SearchCapabilities() musebot.SearchCapabilities {
+	return musebot.SearchCapabilities{Paging: true}
+}
+
+func (p *SubsonicProvider) Search(query musebot.SearchQuery) (musebot.SearchResults, error) {
+	songCount := query.Limit
+	if songCount <= 0 {
+		songCount = 500 // "everything", within reason
+	}
+
+	params := url.Values{}
+	params.Set("query", query.FlatText())
+	params.Set("songCount", strconv.Itoa(songCount))
+	params.Set("songOffset", strconv.Itoa(query.Offset))
+	params.Set("artistCount", "0")
+	params.Set("albumCount", "0")
+
+	res, err := p.apiCall("search3", params)
+	if err != nil {
+		return musebot.SearchResults{make([]musebot.SongInfo, 0), -1}, err
+	}
+
+	results := make([]musebot.SongInfo, 0)
+	if res.SearchResult3 != nil {
+		results = make([]musebot.SongInfo, len(res.SearchResult3.Song))
+		for i, s := range res.SearchResult3.Song {
+			p.subsonicSongToMuseBotSong(s, &results[i])
+		}
+	}
+
+	// search3 doesn't say how many there are in total
+	return musebot.SearchResults{results, -1}, nil
+}
+
+func (p *SubsonicProvider) getSong(id string) (*subsonicSong, error) {
+	res, err := p.apiCall("getSong", url.Values{"id": {id}})
+	if err != nil {
+		return nil, err
+	}
+	if res.Song == nil {
+		return nil, errors.New("That song no longer exists!")
+	}
+	return res.Song, nil
+}
+
+func (p *SubsonicProvider) UpdateSongInfo(song *musebot.SongInfo) error {
+	if song.ProviderName != p.PackageName() {
+		return errors.New("Song was not from this provider!")
+	}
+
+	s, err := p.getSong(song.ProviderId)
+	if err != nil {
+		return err
+	}
+
+	p.subsonicSongToMuseBotSong(*s, song)
+	return nil
+}
+
+func (p *SubsonicProvider) FetchSong(song *musebot.SongInfo, comms chan musebot.ProviderMessage) {
+	if song.ProviderName != p.PackageName() {
+		comms <- musebot.ProviderMessage{"error", errors.New("Song was not from this provider!")}
+		return
+	}
+
+	// we need the file's suffix, which isn't kept in the SongInfo
+	s, err := p.getSong(song.ProviderId)
+	if err != nil {
+		comms <- musebot.ProviderMessage{"error", err}
+		return
+	}
+
+	var downloadUrl, suffix string
+	if p.stream {
+		downloadUrl = p.methodUrl("stream", url.Values{"id": {s.Id}, "format": {p.streamFormat}})
+		suffix = p.streamFormat
+	} else {
+		downloadUrl = p.methodUrl("download", url.Values{"id": {s.Id}})
+		suffix = s.Suffix
+	}
+
+	// the suffix comes from the server, so it can't be trusted near the filesystem
+	downloadLocation := p.cacheDir + "/" + hexSha1(s.Id) + "." + fileExtension(suffix)
+
+	if c, _ := doesFileExist(downloadLocation); !c {
+		comms <- musebot.ProviderMessage{"stages", 1}
+		comms <- musebot.ProviderMessage{"current_stage", 1}
+		comms <- musebot.ProviderMessage{"current_stage_description", "Downloading file..."}
+
+		req, err := http.NewRequest("GET", downloadUrl, nil)
+		if err == nil {
+			_, err = downloadRequestAndReportProgress(p.client, req, downloadLocation, comms)
+		}
+		if err != nil {
+			comms <- musebot.ProviderMessage{"error", err}
+			return
+		}
+	} else {
+		comms <- musebot.ProviderMessage{"stages", 0}
+	}
+
+	song.MusicUrl = downloadLocation
+
+	comms <- musebot.ProviderMessage{"done", nil}
+}
@@ -0,0 +1,215 @@
+package provider
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"musebot"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const (
+	subsonicTestUser     = "tester"
+	subsonicTestPassword = "hunter2"
+)
+
+// fakeSubsonic is a Subsonic server with a couple of songs on it, which
+// checks everyone's token like the real thing.
+func fakeSubsonic() *httptest.Server {
+	songs := map[string]subsonicSong{
+		"1":    {Id: "1", Title: "One", Artist: "Someone", Album: "First", Duration: 180, CoverArt: "al-1", Suffix: "flac"},
+		"evil": {Id: "evil", Title: "Evil", Suffix: "../../../tmp/evil"},
+	}
+	reply := func(w http.ResponseWriter, res subsonicResponse) {
+		json.NewEncoder(w).Encode(subsonicEnvelope{res})
+	}
+	fail := func(w http.ResponseWriter, code int, message string) {
+		reply(w, subsonicResponse{Status: "failed", Error: &subsonicError{code, message}})
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("u") != subsonicTestUser || q.Get("t") != hexMd5(subsonicTestPassword+q.Get("s")) || len(q.Get("s")) == 0 {
+			fail(w, 40, "Wrong username or password")
+			return
+		}
+
+		switch strings.TrimPrefix(r.URL.Path, "/rest/") {
+		case "ping":
+			reply(w, subsonicResponse{Status: "ok"})
+		case "search3":
+			res := subsonicResponse{Status: "ok", SearchResult3: &struct {
+				Song []subsonicSong `json:"song"`
+			}{[]subsonicSong{songs["1"]}}}
+			reply(w, res)
+		case "getSong":
+			s, ok := songs[q.Get("id")]
+			if !ok {
+				fail(w, 70, "Song not found")
+				return
+			}
+			reply(w, subsonicResponse{Status: "ok", Song: &s})
+		case "download", "stream":
+			if _, ok := songs[q.Get("id")]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Length", "5")
+			w.Write([]byte("music"))
+		case "getCoverArt":
+			if q.Get("id") != "al-1" {
+				fail(w, 70, "Cover art not found")
+				return
+			}
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("png!"))
+		default:
+			fail(w, 0, "Unknown method")
+		}
+	}))
+}
+
+// countingTransport counts the requests which go through it.
+type countingTransport struct {
+	requests int32
+}
+
+func (ct *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&ct.requests, 1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func newTestSubsonicProvider(t *testing.T, baseUrl string, cfg map[string]string) (*SubsonicProvider, error) {
+	config := map[string]string{
+		"baseUrl":  baseUrl,
+		"username": subsonicTestUser,
+		"password": subsonicTestPassword,
+		"cacheDir": t.TempDir(),
+	}
+	for k, v := range cfg {
+		config[k] = v
+	}
+	p := new(SubsonicProvider)
+	return p, p.Setup(config)
+}
+
+func TestSubsonicSetup(t *testing.T) {
+	srv := fakeSubsonic()
+	defer srv.Close()
+
+	if _, err := newTestSubsonicProvider(t, srv.URL, nil); err != nil {
+		t.Errorf("setting up with the right password: %v", err)
+	}
+	if _, err := newTestSubsonicProvider(t, srv.URL, map[string]string{"password": "wrong"}); err == nil {
+		t.Error("setting up with the wrong password should fail")
+	}
+	if _, err := newTestSubsonicProvider(t, srv.URL, map[string]string{"fetchMethod": "carrier pigeon"}); err == nil {
+		t.Error("setting up with a made up fetchMethod should fail")
+	}
+}
+
+func TestSubsonicErrorsHideCredentials(t *testing.T) {
+	srv := fakeSubsonic()
+	srv.Close()
+
+	_, err := newTestSubsonicProvider(t, srv.URL, nil)
+	if err == nil {
+		t.Fatal("setting up against a server which has gone away should fail")
+	}
+	if strings.Contains(err.Error(), subsonicTestUser) || strings.Contains(err.Error(), "t=") {
+		t.Errorf("error gives away our credentials: %v", err)
+	}
+}
+
+func TestSubsonicSearch(t *testing.T) {
+	srv := fakeSubsonic()
+	defer srv.Close()
+	p, err := newTestSubsonicProvider(t, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := p.Search(musebot.SearchQuery{Text: "one", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Results) != 1 {
+		t.Fatalf("got %d results, want 1", len(res.Results))
+	}
+	si := res.Results[0]
+	if si.Title != "One" || si.Artist != "Someone" || si.Album != "First" || si.Length != 180 || si.ProviderId != "1" {
+		t.Errorf("result is %+v", si)
+	}
+
+	// cover art comes through musebot, so clients never see our token
+	if want := musebot.CoverArtProxyUrl(p.PackageName(), "al-1"); si.CoverArtUrl != want {
+		t.Errorf("cover art is at %q, want %q", si.CoverArtUrl, want)
+	}
+}
+
+func TestSubsonicFetchCoverArt(t *testing.T) {
+	srv := fakeSubsonic()
+	defer srv.Close()
+	p, err := newTestSubsonicProvider(t, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, contentType, err := p.FetchCoverArt("al-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(image)
+	image.Close()
+	if string(b) != "png!" || contentType != "image/png" {
+		t.Errorf("got %q as %q, want %q as %q", b, contentType, "png!", "image/png")
+	}
+
+	if _, _, err := p.FetchCoverArt("missing"); err == nil {
+		t.Error("fetching cover art the server doesn't have should fail")
+	}
+}
+
+func TestSubsonicFetchSong(t *testing.T) {
+	srv := fakeSubsonic()
+	defer srv.Close()
+
+	tests := []struct {
+		cfg     map[string]string
+		id, ext string
+	}{
+		{nil, "1", ".flac"},
+		{nil, "evil", ".mp3"}, // a suffix which would escape the cache
+		{map[string]string{"fetchMethod": "stream", "streamFormat": "ogg"}, "1", ".ogg"},
+	}
+	for _, test := range tests {
+		p, err := newTestSubsonicProvider(t, srv.URL, test.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transport := &countingTransport{}
+		p.client = &http.Client{Transport: transport}
+
+		si := musebot.SongInfo{ProviderName: p.PackageName(), ProviderId: test.id}
+		m := lastMessage(fetchAll(p, &si))
+		if m.Type != "done" {
+			t.Errorf("fetching %q: %v", test.id, m.Content)
+			continue
+		}
+		if filepath.Dir(si.MusicUrl) != p.cacheDir || filepath.Ext(si.MusicUrl) != test.ext {
+			t.Errorf("fetching %q: got %q, want a %s file in %s", test.id, si.MusicUrl, test.ext, p.cacheDir)
+			continue
+		}
+		if b, err := ioutil.ReadFile(si.MusicUrl); err != nil || string(b) != "music" {
+			t.Errorf("fetching %q: got %q (%v), want %q", test.id, b, err, "music")
+		}
+		// getSong, then the download itself
+		if n := atomic.LoadInt32(&transport.requests); n != 2 {
+			t.Errorf("fetching %q made %d requests with the provider's client, want 2", test.id, n)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func at(year int, month time.Month, day int, hour int, minute int) time.Time {
+	return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestMatches(t *testing.T) {
+	// 2024-01-01 was a Monday, and 2024-01-07 a Sunday
+	tests := []struct {
+		expr string
+		t    time.Time
+		want bool
+	}{
+		{"* * * * *", at(2024, 1, 1, 0, 0), true},
+		{"30 9 * * *", at(2024, 1, 1, 9, 30), true},
+		{"30 9 * * *", at(2024, 1, 1, 9, 31), false},
+		{"30 9 * * *", at(2024, 1, 1, 10, 30), false},
+
+		// ranges and lists
+		{"0-15 * * * *", at(2024, 1, 1, 0, 15), true},
+		{"0-15 * * * *", at(2024, 1, 1, 0, 16), false},
+		{"0 22-23,0-6 * * *", at(2024, 1, 1, 23, 0), true},
+		{"0 22-23,0-6 * * *", at(2024, 1, 1, 3, 0), true},
+		{"0 22-23,0-6 * * *", at(2024, 1, 1, 12, 0), false},
+
+		// steps
+		{"*/15 * * * *", at(2024, 1, 1, 0, 45), true},
+		{"*/15 * * * *", at(2024, 1, 1, 0, 40), false},
+		{"5/20 * * * *", at(2024, 1, 1, 0, 5), true},
+		{"5/20 * * * *", at(2024, 1, 1, 0, 45), true},
+		{"5/20 * * * *", at(2024, 1, 1, 0, 20), false},
+		{"0-30/10 * * * *", at(2024, 1, 1, 0, 30), true},
+		{"0-30/10 * * * *", at(2024, 1, 1, 0, 40), false},
+
+		// names
+		{"* * * jan-mar *", at(2024, 2, 1, 0, 0), true},
+		{"* * * jan-mar *", at(2024, 4, 1, 0, 0), false},
+		{"* * * * mon-fri", at(2024, 1, 1, 0, 0), true},
+		{"* * * * mon-fri", at(2024, 1, 7, 0, 0), false},
+		{"* * * * MON", at(2024, 1, 1, 0, 0), true},
+
+		// Sunday is 0 or 7
+		{"* * * * 0", at(2024, 1, 7, 0, 0), true},
+		{"* * * * 7", at(2024, 1, 7, 0, 0), true},
+		{"* * * * sun", at(2024, 1, 7, 0, 0), true},
+		{"* * * * 5-7", at(2024, 1, 7, 0, 0), true},
+		{"* * * * 5-7", at(2024, 1, 5, 0, 0), true},
+		{"* * * * 5-7", at(2024, 1, 4, 0, 0), false},
+
+		// days of the month on their own
+		{"* * 1 * *", at(2024, 1, 1, 0, 0), true},
+		{"* * 1 * *", at(2024, 1, 2, 0, 0), false},
+
+		// with both days given, either will do: 2024-03-15 was a Friday
+		{"* * 13 * fri", at(2024, 3, 15, 0, 0), true},
+		{"* * 13 * fri", at(2024, 3, 13, 0, 0), true},
+		{"* * 13 * fri", at(2024, 3, 14, 0, 0), false},
+	}
+
+	for _, test := range tests {
+		spec, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.expr, err)
+			continue
+		}
+		if got := spec.Matches(test.t); got != test.want {
+			t.Errorf("Parse(%q).Matches(%v) = %v, want %v", test.expr, test.t, got, test.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"* * * foo *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"1-x * * * *",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) should have failed", expr)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package musebot
+
+import (
+	"strings"
+	"unicode"
+)
+
+type SearchQuery struct {
+	Text string // free text, with any field-scoped terms taken out
+
+	Artist string
+	Album  string
+	Title  string
+
+	MinLength int // seconds, 0 means no lower bound
+	MaxLength int // seconds, 0 means no upper bound
+
+	Offset int
+	Limit  int // 0 means "everything"
+}
+
+type SearchResults struct {
+	Results []SongInfo
+	Total   int // -1 if the provider couldn't say
+}
+
+// SearchCapabilities is how a provider declares which parts of a SearchQuery
+// it deals with itself. Anything it doesn't support is emulated on top of
+// its results by provider.Search.
+type SearchCapabilities struct {
+	Paging       bool // honours Offset and Limit
+	FieldScoped  bool // understands Artist, Album and Title
+	LengthFilter bool // honours MinLength and MaxLength
+	Total        bool // fills in SearchResults.Total
+}
+
+func (q SearchQuery) HasFields() bool {
+	return len(q.Artist) != 0 || len(q.Album) != 0 || len(q.Title) != 0
+}
+
+func (q SearchQuery) HasLengthFilter() bool {
+	return q.MinLength > 0 || q.MaxLength > 0
+}
+
+// FlatText folds the field-scoped terms back into a single free text query,
+// for providers which only understand that.
+func (q SearchQuery) FlatText() string {
+	parts := make([]string, 0, 4)
+	for _, s := range []string{q.Text, q.Artist, q.Album, q.Title} {
+		if len(s) != 0 {
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// splitSearchTerms splits on whitespace, except inside double quotes.
+func splitSearchTerms(query string) []string {
+	terms := make([]string, 0)
+	current := make([]rune, 0)
+	inQuotes := false
+	for _, r := range query {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case unicode.IsSpace(r) && !inQuotes:
+			if len(current) != 0 {
+				terms = append(terms, string(current))
+				current = current[:0]
+			}
+		default:
+			current = append(current, r)
+		}
+	}
+	if len(current) != 0 {
+		terms = append(terms, string(current))
+	}
+	return terms
+}
+
+// ParseSearchQuery turns something like `artist:"daft punk" title:one more`
+// into a SearchQuery. Unknown prefixes are left in the free text.
+func ParseSearchQuery(query string) SearchQuery {
+	q := SearchQuery{}
+	text := make([]string, 0)
+	appendTo := func(field *string, value string) {
+		if len(*field) != 0 {
+			*field += " "
+		}
+		*field += value
+	}
+
+	for _, term := range splitSearchTerms(query) {
+		colon := strings.Index(term, ":")
+		if colon <= 0 || colon == len(term)-1 {
+			text = append(text, term)
+			continue
+		}
+		value := term[colon+1:]
+		switch strings.ToLower(term[:colon]) {
+		case "artist":
+			appendTo(&q.Artist, value)
+		case "album":
+			appendTo(&q.Album, value)
+		case "title":
+			appendTo(&q.Title, value)
+		default:
+			text = append(text, term)
+		}
+	}
+	q.Text = strings.Join(text, " ")
+
+	return q
+}
+
+// PagingFor works out the paging metadata to send back for a query which
+// returned the given number of results out of total (-1 if unknown).
+func PagingFor(q SearchQuery, returned int, total int) SearchPaging {
+	sp := SearchPaging{Offset: q.Offset, Limit: q.Limit, Total: total}
+	if total >= 0 {
+		sp.HasMore = q.Offset+returned < total
+	} else {
+		sp.HasMore = q.Limit > 0 && returned >= q.Limit
+	}
+	return sp
+}
@@ -1,5 +1,11 @@
 package musebot
 
+import "net/url"
+
+// AutoplayCulprit is who gets the blame for songs autoplay picked because
+// nobody queued anything.
+const AutoplayCulprit = "<<AUTOPLAY>>"
+
 type SongInfo struct {
 	Title  string
 	Album  string
@@ -16,6 +22,13 @@ type SongInfo struct {
 
 	QueueInfo    *QueuedSongInfo
 	PlaybackInfo *CurrentSongInfo
+	BlockInfo    *BlockedSongInfo // set on search results the blocklist flagged
+}
+
+// CoverArtProxyUrl is where clients can get cover art which a CoverArtFetcher
+// has to fetch for them.
+func CoverArtProxyUrl(providerName string, id string) string {
+	return "/api/cover_art/?" + url.Values{"provider": {providerName}, "id": {id}}.Encode()
 }
 
 type QueuedSongInfo struct {
@@ -28,6 +41,12 @@ type CurrentSongInfo struct {
 	State    string
 }
 
+type FederatedSongInfo struct {
+	SongInfo
+
+	AvailableFrom map[string]string // provider package name -> ProviderId
+}
+
 type FullSongInfo struct {
 	Song         *SongInfo
 	QueueInfo    *QueuedSongInfo